@@ -0,0 +1,73 @@
+// Package caddytest provides a stand-in for the config endpoint of the Caddy admin API, so that the caddy package and
+// the Caddy watcher can be tested without running Caddy.
+package caddytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Server serves the config set with SetConfig on GET /config/, as Caddy does after loading a config.
+type Server struct {
+	URL string
+
+	server   *httptest.Server
+	mu       sync.Mutex
+	config   json.RawMessage
+	status   int
+	requests int
+}
+
+// NewServer starts a Server that runs without config, so GET /config/ answers null. Call Close when done.
+func NewServer() *Server {
+	s := &Server{config: json.RawMessage("null")}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// SetConfig replaces the running config with config, the JSON of a Caddy config.
+func (s *Server) SetConfig(config string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = json.RawMessage(config)
+}
+
+// SetStatus makes GET /config/ fail with status, or succeed again with http.StatusOK.
+func (s *Server) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Requests returns the number of config reads.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.URL.Path != "/config/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.status != 0 && s.status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(s.status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(s.status)})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(s.config)
+}
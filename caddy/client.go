@@ -0,0 +1,106 @@
+package caddy
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"sort"
+	"strings"
+)
+
+// DefaultURL is the admin API of Caddy with its default admin listener.
+const DefaultURL = "http://localhost:2019"
+
+// Config is the part of the running Caddy config that holds the routes of the http app.
+// Configs loaded from a Caddyfile are served adapted to JSON, so they read the same.
+type Config struct {
+	Apps struct {
+		HTTP *HTTPApp `json:"http"`
+	} `json:"apps"`
+}
+
+// HTTPApp is the http app with its servers by name, e.g. "srv0".
+type HTTPApp struct {
+	Servers map[string]Server `json:"servers"`
+}
+
+// Server is a server of the http app.
+type Server struct {
+	Listen []string `json:"listen"`
+	Routes []Route  `json:"routes"`
+}
+
+// Route is a route of a server or of a subroute handler. A route applies if any of its matcher sets matches.
+type Route struct {
+	Match  []MatcherSet `json:"match"`
+	Handle []Handler    `json:"handle"`
+}
+
+// MatcherSet is a set of request matchers of which only the host matcher is read.
+type MatcherSet struct {
+	Host []string `json:"host"`
+}
+
+// Handler is a handler of a route. Subroute handlers have routes of their own.
+type Handler struct {
+	Handler string  `json:"handler"`
+	Routes  []Route `json:"routes"`
+}
+
+// Client reads the running config of Caddy through its admin API, e.g. DefaultURL.
+type Client struct {
+	client *resty.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{client: resty.New().SetBaseURL(strings.TrimSuffix(url, "/"))}
+}
+
+// Config reads the running config. Caddy serves null while it runs without config, which reads as an empty Config.
+func (c *Client) Config(ctx context.Context) (Config, error) {
+	var config Config
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetResult(&config).
+		Get("/config/")
+	if err != nil {
+		return Config{}, err
+	}
+	if resp.IsError() {
+		return Config{}, fmt.Errorf("/config/: %v", resp.Status())
+	}
+	return config, nil
+}
+
+// Hosts returns the sorted hostnames of every host matcher in the routes of the http app, including nested subroutes.
+// Wildcards such as "*.example.com" and placeholders such as "{env.HOST}" are skipped.
+func (config Config) Hosts() []string {
+	if config.Apps.HTTP == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var hosts []string
+	var collect func(routes []Route)
+	collect = func(routes []Route) {
+		for _, route := range routes {
+			for _, matcherSet := range route.Match {
+				for _, host := range matcherSet.Host {
+					host = strings.ToLower(strings.TrimSpace(host))
+					if host == "" || seen[host] || strings.ContainsAny(host, "*{") {
+						continue
+					}
+					seen[host] = true
+					hosts = append(hosts, host)
+				}
+			}
+			for _, handler := range route.Handle {
+				collect(handler.Routes)
+			}
+		}
+	}
+	for _, server := range config.Apps.HTTP.Servers {
+		collect(server.Routes)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
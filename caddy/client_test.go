@@ -0,0 +1,100 @@
+package caddy
+
+import (
+	"OPNsenseProxyAPI/caddy/caddytest"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// adaptedCaddyfile is the config Caddy serves for a Caddyfile with the site blocks
+// "app1.example.com, App2.example.com", "*.example.com" and "app3.example.com" with a handle block.
+const adaptedCaddyfile = `{
+  "apps": {
+    "http": {
+      "servers": {
+        "srv0": {
+          "listen": [":443"],
+          "routes": [
+            {
+              "match": [{"host": ["app1.example.com", "App2.example.com"]}],
+              "handle": [{"handler": "subroute", "routes": [{"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "app:8080"}]}]}]}],
+              "terminal": true
+            },
+            {
+              "match": [{"host": ["*.example.com"]}],
+              "handle": [{"handler": "static_response", "body": "wildcard"}],
+              "terminal": true
+            },
+            {
+              "match": [{"host": ["app3.example.com"]}],
+              "handle": [{
+                "handler": "subroute",
+                "routes": [{"match": [{"host": ["api.example.com"], "path": ["/api/*"]}, {"not": [{"host": ["internal.example.com"]}]}]}]
+              }],
+              "terminal": true
+            }
+          ]
+        },
+        "srv1": {
+          "listen": [":8443"],
+          "routes": [{"match": [{"host": ["app1.example.com", "{env.APP_HOST}"]}]}]
+        }
+      }
+    },
+    "tls": {"automation": {"policies": [{"subjects": ["tls.example.com"]}]}}
+  }
+}`
+
+func TestConfig_Hosts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{name: "no config", config: "null", want: nil},
+		{name: "no http app", config: `{"apps": {"tls": {}}}`, want: nil},
+		{name: "adapted Caddyfile", config: adaptedCaddyfile, want: []string{"api.example.com", "app1.example.com", "app2.example.com", "app3.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			if err := json.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if got := config.Hosts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Config(t *testing.T) {
+	server := caddytest.NewServer()
+	defer server.Close()
+	client := NewClient(server.URL + "/")
+
+	config, err := client.Config(context.Background())
+	if err != nil {
+		t.Fatalf("Config() without config error = %v", err)
+	}
+	if config.Apps.HTTP != nil {
+		t.Errorf("Config() without config got http app %+v, want none", config.Apps.HTTP)
+	}
+
+	server.SetConfig(adaptedCaddyfile)
+	config, err = client.Config(context.Background())
+	if err != nil {
+		t.Fatalf("Config() error = %v", err)
+	}
+	if got := config.Hosts(); len(got) != 4 {
+		t.Errorf("Config().Hosts() = %v, want 4 hosts", got)
+	}
+
+	server.SetStatus(http.StatusInternalServerError)
+	if _, err := client.Config(context.Background()); err == nil {
+		t.Errorf("Config() of failing admin API error = nil, want error")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/caddy"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// caddyWatcher polls the running config of Caddy and syncs the hostnames of its host matchers as aliases of the watched host.
+type caddyWatcher struct {
+	client   *caddy.Client
+	interval time.Duration
+	watcher  *aliasWatcher
+}
+
+func newCaddyWatcher(cfg watchConfig) (*caddyWatcher, error) {
+	if cfg.Caddy.URL == "" {
+		cfg.Caddy.URL = caddy.DefaultURL
+	}
+	interval, err := parseDuration(cfg.Caddy.PollInterval, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CADDY_POLL_INTERVAL: %w", err)
+	}
+	if interval <= 0 {
+		return nil, errors.New("CADDY_POLL_INTERVAL must be positive")
+	}
+	w := &caddyWatcher{client: caddy.NewClient(cfg.Caddy.URL), interval: interval}
+	w.watcher, err = newAliasWatcher("caddy", cfg, w.aliases)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Run syncs the hostnames of the running config every interval until ctx is done.
+func (w *caddyWatcher) Run(ctx context.Context) {
+	w.watcher.poll(ctx, w.interval)
+}
+
+// aliases returns the hostnames of the host matchers of the running config.
+func (w *caddyWatcher) aliases(ctx context.Context) ([]string, error) {
+	config, err := w.client.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return config.Hosts(), nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings of the service. They are read from the YAML file in CONFIG_FILE, if set,
+// and every environment variable that is set overrides the matching setting of the file.
+type config struct {
+	// OPNsense is the firewall configured by the environment variables. It is named "default" unless it has a name.
+	OPNsense opnsenseConfig `yaml:"opnsense"`
+	// Targets are further firewalls, e.g. the second node of a CARP pair. Every change is applied to all of them.
+	Targets []opnsenseConfig `yaml:"targets"`
+	// SyncMode is syncModeAll (the default) or syncModeBestEffort.
+	SyncMode string `yaml:"syncMode"`
+	// Domains are the managed domains. FQDNs are split into hostname and domain on the longest matching domain.
+	Domains        []string         `yaml:"domains"`
+	APITokens      []apiTokenConfig `yaml:"apiTokens"`
+	TrustedProxies []string         `yaml:"trustedProxies"`
+	StateFile      string           `yaml:"stateFile"`
+	// durations, e.g. "5m"
+	ReconcileInterval      string `yaml:"reconcileInterval"`
+	LeaseDuration          string `yaml:"leaseDuration"`
+	ReconfigureQuietPeriod string `yaml:"reconfigureQuietPeriod"`
+	ReconfigureMaxDelay    string `yaml:"reconfigureMaxDelay"`
+	// LogFormat is "text" or "json", LogLevel a logrus level, e.g. "debug"
+	LogFormat string `yaml:"logFormat"`
+	LogLevel  string `yaml:"logLevel"`
+	// Watch configures the run modes that discover aliases, e.g. watch-docker
+	Watch watchConfig `yaml:"watch"`
+	// WebhookAddress is where the ExternalDNS webhook is served, e.g. "localhost:8888". It is off when empty.
+	WebhookAddress string `yaml:"webhookAddress"`
+	// WebhookAllowRemote allows a WebhookAddress other than loopback. The webhook has no authentication.
+	WebhookAllowRemote bool `yaml:"webhookAllowRemote"`
+}
+
+type opnsenseConfig struct {
+	Name               string `yaml:"name"`
+	Address            string `yaml:"address"`
+	APIKey             string `yaml:"apiKey"`
+	APISecret          string `yaml:"apiSecret"`
+	CAFile             string `yaml:"caFile"`
+	CertSHA256         string `yaml:"certSHA256"`
+	ClientCert         string `yaml:"clientCert"`
+	ClientKey          string `yaml:"clientKey"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// watchConfig is the host whose aliases are discovered and the sources they are discovered from.
+type watchConfig struct {
+	// Host is the FQDN of the host override the discovered aliases point to, with Addresses as its A and AAAA records
+	Host       string                `yaml:"host"`
+	Addresses  []string              `yaml:"addresses"`
+	Docker     dockerWatchConfig     `yaml:"docker"`
+	Traefik    traefikWatchConfig    `yaml:"traefik"`
+	Caddy      caddyWatchConfig      `yaml:"caddy"`
+	Kubernetes kubernetesWatchConfig `yaml:"kubernetes"`
+}
+
+type dockerWatchConfig struct {
+	Host  string `yaml:"host"`
+	Label string `yaml:"label"`
+}
+
+type traefikWatchConfig struct {
+	URL string `yaml:"url"`
+	// PollInterval is a duration, e.g. "30s"
+	PollInterval string `yaml:"pollInterval"`
+}
+
+type kubernetesWatchConfig struct {
+	// APIURL is the API server. The service account of the pod is used when it is empty.
+	APIURL    string `yaml:"apiURL"`
+	TokenFile string `yaml:"tokenFile"`
+	CAFile    string `yaml:"caFile"`
+	// Namespace limits the watched objects to one namespace.
+	Namespace string `yaml:"namespace"`
+	// ResyncInterval is a duration, e.g. "5m"
+	ResyncInterval string `yaml:"resyncInterval"`
+}
+
+type caddyWatchConfig struct {
+	URL string `yaml:"url"`
+	// PollInterval is a duration, e.g. "30s"
+	PollInterval string `yaml:"pollInterval"`
+}
+
+// apiTokenConfig is a bearer token and the FQDN patterns it may manage, see newAPITokens.
+type apiTokenConfig struct {
+	Token string   `yaml:"token"`
+	Hosts []string `yaml:"hosts"`
+}
+
+// loadConfig reads the configuration file at path, which may be empty, and applies the environment variables.
+func loadConfig(path string) (config, error) {
+	var cfg config
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&cfg)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("parsing %v: %w", path, err)
+		}
+	}
+	err := cfg.applyEnv()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Domains = normalizeDomains(cfg.Domains)
+	switch cfg.SyncMode {
+	case "":
+		cfg.SyncMode = syncModeAll
+	case syncModeAll, syncModeBestEffort:
+	default:
+		return cfg, fmt.Errorf("invalid sync mode %q, must be %v or %v", cfg.SyncMode, syncModeAll, syncModeBestEffort)
+	}
+	leaseDuration, err := parseDuration(cfg.LeaseDuration, 0)
+	if err != nil {
+		return cfg, fmt.Errorf("parsing LEASE_DURATION: %w", err)
+	}
+	// leases are only kept in the state file, so without it a restart would forget them and never expire their hosts
+	if leaseDuration > 0 && cfg.StateFile == "" {
+		return cfg, errors.New("LEASE_DURATION requires STATE_FILE to keep leases across restarts")
+	}
+	// anybody who reaches the webhook can change the records of ExternalDNS, so it is only served on loopback by default
+	if cfg.WebhookAddress != "" && !cfg.WebhookAllowRemote && !isLoopbackAddress(cfg.WebhookAddress) {
+		return cfg, fmt.Errorf("WEBHOOK_ADDRESS %v is not a loopback address, set WEBHOOK_ALLOW_REMOTE to serve the unauthenticated webhook on it", cfg.WebhookAddress)
+	}
+	return cfg, nil
+}
+
+// isLoopbackAddress reports whether the listen address, e.g. "localhost:8888", only accepts connections from this host.
+// An address without host, e.g. ":8888", listens on every interface.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// targetConfigs returns the OPNsense section followed by the targets, checking that every firewall
+// has a unique name, an address and credentials.
+func (cfg config) targetConfigs() ([]opnsenseConfig, error) {
+	var targetConfigs []opnsenseConfig
+	if cfg.OPNsense != (opnsenseConfig{}) {
+		defaultConfig := cfg.OPNsense
+		if defaultConfig.Name == "" {
+			defaultConfig.Name = "default"
+		}
+		targetConfigs = append(targetConfigs, defaultConfig)
+	}
+	targetConfigs = append(targetConfigs, cfg.Targets...)
+	if len(targetConfigs) == 0 {
+		return nil, errors.New("OPNSENSE_ADDRESS not set")
+	}
+	names := make(map[string]bool)
+	for _, targetConfig := range targetConfigs {
+		switch {
+		case targetConfig.Name == "":
+			return nil, fmt.Errorf("target %v has no name", targetConfig.Address)
+		case names[targetConfig.Name]:
+			return nil, fmt.Errorf("target name %v is used twice", targetConfig.Name)
+		case targetConfig.Address == "":
+			return nil, fmt.Errorf("target %v has no address", targetConfig.Name)
+		case targetConfig.APIKey == "" || targetConfig.APISecret == "":
+			return nil, fmt.Errorf("target %v has no API key and secret", targetConfig.Name)
+		}
+		names[targetConfig.Name] = true
+	}
+	return targetConfigs, nil
+}
+
+func (cfg *config) applyEnv() error {
+	overrideWithEnv(&cfg.OPNsense.Address, "OPNSENSE_ADDRESS")
+	overrideWithEnv(&cfg.OPNsense.APIKey, "API_KEY")
+	overrideWithEnv(&cfg.OPNsense.APISecret, "API_SECRET")
+	overrideWithEnv(&cfg.OPNsense.CAFile, "OPNSENSE_CA_FILE")
+	overrideWithEnv(&cfg.OPNsense.CertSHA256, "OPNSENSE_CERT_SHA256")
+	overrideWithEnv(&cfg.OPNsense.ClientCert, "OPNSENSE_CLIENT_CERT")
+	overrideWithEnv(&cfg.OPNsense.ClientKey, "OPNSENSE_CLIENT_KEY")
+	overrideWithEnv(&cfg.SyncMode, "SYNC_MODE")
+	overrideWithEnv(&cfg.StateFile, "STATE_FILE")
+	overrideWithEnv(&cfg.ReconcileInterval, "RECONCILE_INTERVAL")
+	overrideWithEnv(&cfg.LeaseDuration, "LEASE_DURATION")
+	overrideWithEnv(&cfg.ReconfigureQuietPeriod, "RECONFIGURE_QUIET_PERIOD")
+	overrideWithEnv(&cfg.ReconfigureMaxDelay, "RECONFIGURE_MAX_DELAY")
+	overrideWithEnv(&cfg.LogFormat, "LOG_FORMAT")
+	overrideWithEnv(&cfg.LogLevel, "LOG_LEVEL")
+	overrideWithEnv(&cfg.Watch.Host, "WATCH_HOST")
+	overrideWithEnv(&cfg.Watch.Docker.Host, "DOCKER_HOST")
+	overrideWithEnv(&cfg.Watch.Docker.Label, "DOCKER_ALIAS_LABEL")
+	overrideWithEnv(&cfg.Watch.Traefik.URL, "TRAEFIK_URL")
+	overrideWithEnv(&cfg.Watch.Traefik.PollInterval, "TRAEFIK_POLL_INTERVAL")
+	overrideWithEnv(&cfg.Watch.Caddy.URL, "CADDY_ADMIN_URL")
+	overrideWithEnv(&cfg.Watch.Caddy.PollInterval, "CADDY_POLL_INTERVAL")
+	overrideWithEnv(&cfg.Watch.Kubernetes.APIURL, "KUBE_API_URL")
+	overrideWithEnv(&cfg.Watch.Kubernetes.TokenFile, "KUBE_TOKEN_FILE")
+	overrideWithEnv(&cfg.Watch.Kubernetes.CAFile, "KUBE_CA_FILE")
+	overrideWithEnv(&cfg.Watch.Kubernetes.Namespace, "KUBE_NAMESPACE")
+	overrideWithEnv(&cfg.Watch.Kubernetes.ResyncInterval, "KUBE_RESYNC_INTERVAL")
+	overrideWithEnv(&cfg.WebhookAddress, "WEBHOOK_ADDRESS")
+	if value := os.Getenv("OPNSENSE_INSECURE_SKIP_VERIFY"); value != "" {
+		insecureSkipVerify, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for OPNSENSE_INSECURE_SKIP_VERIFY", value)
+		}
+		cfg.OPNsense.InsecureSkipVerify = insecureSkipVerify
+	}
+	if value := os.Getenv("WEBHOOK_ALLOW_REMOTE"); value != "" {
+		allowRemote, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for WEBHOOK_ALLOW_REMOTE", value)
+		}
+		cfg.WebhookAllowRemote = allowRemote
+	}
+	if value := os.Getenv("DOMAIN_NAME"); value != "" {
+		cfg.Domains = strings.Split(value, ",")
+	}
+	if value := os.Getenv("API_TOKENS"); value != "" {
+		tokens, err := parseAPITokens(value)
+		if err != nil {
+			return fmt.Errorf("parsing API_TOKENS: %w", err)
+		}
+		cfg.APITokens = tokens
+	}
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		cfg.TrustedProxies = strings.Split(value, ",")
+	}
+	if value := os.Getenv("WATCH_ADDRESSES"); value != "" {
+		cfg.Watch.Addresses = strings.Split(value, ",")
+	}
+	return nil
+}
+
+func overrideWithEnv(setting *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*setting = value
+	}
+}
+
+// normalizeDomains lowercases domains and drops empty entries, duplicates and trailing dots.
+func normalizeDomains(domains []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = canonicalFQDN(domain)
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		normalized = append(normalized, domain)
+	}
+	return normalized
+}
+
+func (cfg opnsenseConfig) tlsOptions() opnsense.TLSOptions {
+	return opnsense.TLSOptions{
+		CAFile:             cfg.CAFile,
+		PinnedSHA256:       cfg.CertSHA256,
+		ClientCertFile:     cfg.ClientCert,
+		ClientKeyFile:      cfg.ClientKey,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+}
+
+// parseDuration parses a duration setting, e.g. "5m". Empty settings are fallback.
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultHost is the socket of the Docker Engine API on Linux.
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Container is a running container as listed by the Docker Engine API.
+type Container struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+}
+
+// Event is a container event, e.g. "start" or "die", as streamed by the Docker Engine API.
+type Event struct {
+	Type   string     `json:"Type"`
+	Action string     `json:"Action"`
+	Actor  EventActor `json:"Actor"`
+}
+
+// EventActor is the container an Event is about, with its labels as Attributes.
+type EventActor struct {
+	ID         string            `json:"ID"`
+	Attributes map[string]string `json:"Attributes"`
+}
+
+// Client reads containers and events from the Docker Engine API served on a unix socket.
+type Client struct {
+	client *resty.Client
+}
+
+// NewClient creates a Client for host, e.g. DefaultHost. Only unix sockets are supported.
+func NewClient(host string) (*Client, error) {
+	socket := strings.TrimPrefix(host, "unix://")
+	if socket == "" || strings.Contains(socket, "://") {
+		return nil, fmt.Errorf("docker host %q is not a unix socket", host)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	client := resty.New().SetTransport(transport).SetBaseURL("http://docker")
+	return &Client{client: client}, nil
+}
+
+// ListContainers lists the running containers that have label, whatever its value.
+func (c *Client) ListContainers(ctx context.Context, label string) ([]Container, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+	var containers []Container
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetQueryParam("filters", string(filters)).
+		SetResult(&containers).
+		Get("/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.New(resp.Status())
+	}
+	return containers, nil
+}
+
+// Events streams the start and die events of containers with label to handle until ctx is done or the stream ends.
+func (c *Client) Events(ctx context.Context, label string, handle func(Event)) error {
+	filters, err := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die"},
+		"label": {label},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetQueryParam("filters", string(filters)).
+		SetDoNotParseResponse(true).
+		Get("/events")
+	if err != nil {
+		return err
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.IsError() {
+		return errors.New(resp.Status())
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var event Event
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return fmt.Errorf("decoding event: %w", err)
+		}
+		handle(event)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
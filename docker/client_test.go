@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"OPNsenseProxyAPI/docker/dockertest"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*dockertest.Server, *Client) {
+	server, err := dockertest.NewServer(filepath.Join(t.TempDir(), "docker.sock"))
+	if err != nil {
+		t.Fatalf("dockertest.NewServer() error = %v", err)
+	}
+	t.Cleanup(server.Close)
+	client, err := NewClient("unix://" + server.SocketPath)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return server, client
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: DefaultHost},
+		{host: "/run/user/1000/docker.sock"},
+		{host: "tcp://10.0.0.5:2375", wantErr: true},
+		{host: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if _, err := NewClient(tt.host); (err != nil) != tt.wantErr {
+				t.Errorf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClient_ListContainers(t *testing.T) {
+	server, client := newTestServer(t)
+	server.StartContainer("app1", map[string]string{"opnsense.alias": "app1.example.com"})
+	server.StartContainer("db", map[string]string{"other": "label"})
+
+	containers, err := client.ListContainers(context.Background(), "opnsense.alias")
+	if err != nil {
+		t.Fatalf("ListContainers() error = %v", err)
+	}
+	want := []Container{{ID: "app1", Names: []string{"/app1"}, Labels: map[string]string{"opnsense.alias": "app1.example.com"}, State: "running"}}
+	if !reflect.DeepEqual(containers, want) {
+		t.Errorf("ListContainers() got = %+v, want %+v", containers, want)
+	}
+}
+
+func TestClient_Events(t *testing.T) {
+	server, client := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan Event, 2)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Events(ctx, "opnsense.alias", func(event Event) { events <- event })
+	}()
+	for server.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	server.StartContainer("db", map[string]string{"other": "label"})
+	server.StartContainer("app1", map[string]string{"opnsense.alias": "app1.example.com"})
+	server.StopContainer("app1")
+
+	for _, wantAction := range []string{"start", "die"} {
+		select {
+		case event := <-events:
+			if event.Action != wantAction || event.Actor.ID != "app1" {
+				t.Errorf("Events() got %+v, want %v of app1", event, wantAction)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Events() got no %v event", wantAction)
+		}
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Events() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,200 @@
+// Package dockertest provides an in-memory stand-in for the parts of the Docker Engine API used by the docker package,
+// served on a unix socket, so that container watchers can be tested without a Docker daemon.
+package dockertest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Container is a container as stored by the server.
+type Container struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+}
+
+type event struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Server serves GET /containers/json and GET /events on SocketPath.
+type Server struct {
+	SocketPath string
+
+	server      *httptest.Server
+	done        chan struct{}
+	mu          sync.Mutex
+	containers  []Container
+	subscribers map[chan event]map[string][]string
+}
+
+// NewServer starts a Server without containers listening on socketPath. Call Close when done.
+func NewServer(socketPath string) (*Server, error) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		SocketPath:  socketPath,
+		done:        make(chan struct{}),
+		subscribers: make(map[chan event]map[string][]string),
+	}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.server.Listener.Close()
+	s.server.Listener = listener
+	s.server.Start()
+	return s, nil
+}
+
+// Close ends every event stream and stops the server.
+func (s *Server) Close() {
+	close(s.done)
+	s.server.Close()
+}
+
+// StartContainer adds a running container and sends its start event.
+func (s *Server) StartContainer(id string, labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers = append(s.containers, Container{ID: id, Names: []string{"/" + id}, Labels: labels, State: "running"})
+	s.publish("start", id, labels)
+}
+
+// StopContainer removes a container and sends its die event.
+func (s *Server) StopContainer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, container := range s.containers {
+		if container.ID == id {
+			s.containers = append(s.containers[:i], s.containers[i+1:]...)
+			s.publish("die", id, container.Labels)
+			return
+		}
+	}
+}
+
+// Subscribers returns the number of open event streams.
+func (s *Server) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+func (s *Server) publish(action, id string, labels map[string]string) {
+	var e event
+	e.Type = "container"
+	e.Action = action
+	e.Actor.ID = id
+	e.Actor.Attributes = labels
+	for subscriber, filters := range s.subscribers {
+		if matches(filters, e.Type, e.Action, labels) {
+			subscriber <- e
+		}
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var filters map[string][]string
+	if value := r.URL.Query().Get("filters"); value != "" {
+		if err := json.Unmarshal([]byte(value), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/json"):
+		s.listContainers(w, filters)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/events"):
+		s.streamEvents(w, r, filters)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) listContainers(w http.ResponseWriter, filters map[string][]string) {
+	s.mu.Lock()
+	containers := []Container{}
+	for _, container := range s.containers {
+		if matchesLabels(filters["label"], container.Labels) {
+			containers = append(containers, container)
+		}
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(containers)
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, filters map[string][]string) {
+	// buffered, so that publishing does not block while the stream writes
+	events := make(chan event, 16)
+	s.mu.Lock()
+	s.subscribers[events] = filters
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, events)
+		s.mu.Unlock()
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case e := <-events:
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func matches(filters map[string][]string, eventType, action string, labels map[string]string) bool {
+	return contains(filters["type"], eventType) && contains(filters["event"], action) && matchesLabels(filters["label"], labels)
+}
+
+// contains reports whether value is one of values. An empty filter matches everything.
+func contains(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLabels reports whether labels has every filter, given as "key" or "key=value".
+func matchesLabels(filters []string, labels map[string]string) bool {
+	for _, filter := range filters {
+		key, value, hasValue := strings.Cut(filter, "=")
+		actual, found := labels[key]
+		if !found || (hasValue && actual != value) {
+			return false
+		}
+	}
+	return true
+}
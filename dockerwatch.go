@@ -0,0 +1,94 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/docker"
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDockerAliasLabel = "opnsense.alias"
+
+// dockerWatcher syncs the aliases listed in the alias label of the running containers as aliases of the watched host,
+// once at start and again whenever a container with the label starts or stops.
+type dockerWatcher struct {
+	client  *docker.Client
+	label   string
+	watcher *aliasWatcher
+}
+
+func newDockerWatcher(cfg watchConfig) (*dockerWatcher, error) {
+	if cfg.Docker.Host == "" {
+		cfg.Docker.Host = docker.DefaultHost
+	}
+	if cfg.Docker.Label == "" {
+		cfg.Docker.Label = defaultDockerAliasLabel
+	}
+	client, err := docker.NewClient(cfg.Docker.Host)
+	if err != nil {
+		return nil, err
+	}
+	w := &dockerWatcher{client: client, label: cfg.Docker.Label}
+	w.watcher, err = newAliasWatcher("docker", cfg, w.aliases)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Run syncs the aliases of the running containers and follows the Docker events until ctx is done.
+func (w *dockerWatcher) Run(ctx context.Context) {
+	trigger := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.streamEvents(ctx, trigger)
+	}()
+	w.watcher.run(ctx, trigger)
+	wg.Wait()
+}
+
+// aliases returns the aliases in the label of the running containers. A label may list several aliases separated by commas.
+func (w *dockerWatcher) aliases(ctx context.Context) ([]string, error) {
+	containers, err := w.client.ListContainers(ctx, w.label)
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, container := range containers {
+		for _, alias := range strings.Split(container.Labels[w.label], ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	return aliases, nil
+}
+
+// streamEvents fires trigger for every start and stop of a container with the label until ctx is done.
+// The stream is reopened after a delay when it fails, followed by a sync for the events that were missed.
+func (w *dockerWatcher) streamEvents(ctx context.Context, trigger chan<- struct{}) {
+	for {
+		err := w.client.Events(ctx, w.label, func(event docker.Event) {
+			log.Debugf("Container %v: %v", event.Actor.ID, event.Action)
+			notify(trigger)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("event stream ended")
+		}
+		log.Errorf("Error while watching Docker events: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.watcher.retryInterval):
+		}
+		notify(trigger)
+	}
+}
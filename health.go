@@ -0,0 +1,101 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var readiness = newReadinessChecker(5*time.Second, 10*time.Second)
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// readinessResponse tells whether the targets can be managed with the configured credentials, which depends on syncMode:
+// every target must be ready in syncModeAll and one in syncModeBestEffort. Reason and Error are those of the first target
+// that is not ready.
+type readinessResponse struct {
+	Ready     bool              `json:"ready"`
+	Reason    string            `json:"reason,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	CheckedAt time.Time         `json:"checkedAt"`
+	Targets   []targetReadiness `json:"targets"`
+}
+
+// targetReadiness tells whether one target can be managed. Reason is one of the opnsense.Failure* reasons.
+type targetReadiness struct {
+	Target string `json:"target"`
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readinessChecker lists the host overrides of every target and caches the outcome,
+// so frequent healthchecks don't put load on OPNsense.
+type readinessChecker struct {
+	timeout  time.Duration
+	cacheFor time.Duration
+
+	mu   sync.Mutex
+	last *readinessResponse
+}
+
+func newReadinessChecker(timeout, cacheFor time.Duration) *readinessChecker {
+	return &readinessChecker{timeout: timeout, cacheFor: cacheFor}
+}
+
+// check probes the targets unless the last result is younger than cacheFor. Concurrent checks wait for a single probe.
+// The probe does not use the context of a request, so a client that gives up does not cache its cancellation as the
+// readiness of every other client.
+func (checker *readinessChecker) check(now time.Time) readinessResponse {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.last != nil && now.Sub(checker.last.CheckedAt) < checker.cacheFor {
+		return *checker.last
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checker.timeout)
+	defer cancel()
+	result := readinessResponse{CheckedAt: now, Targets: make([]targetReadiness, len(targets))}
+	forEachTarget(func(i int, t *target) *syncError {
+		result.Targets[i] = targetReadiness{Target: t.name, Ready: true}
+		_, err := t.client.GetHostOverridesContext(ctx)
+		if err != nil {
+			result.Targets[i] = targetReadiness{Target: t.name, Ready: false, Reason: opnsense.FailureReason(err), Error: err.Error()}
+			log.Warnf("OPNsense target %v is not ready (%v): %v", t.name, result.Targets[i].Reason, err)
+		}
+		return nil
+	})
+	ready := 0
+	for _, targetResult := range result.Targets {
+		if targetResult.Ready {
+			ready++
+		} else if result.Reason == "" {
+			result.Reason, result.Error = targetResult.Reason, targetResult.Error
+		}
+	}
+	result.Ready = enoughTargetsSucceeded(ready)
+	if result.Ready {
+		result.Reason, result.Error = "", ""
+	}
+	checker.last = &result
+	return result
+}
+
+// handleHealthzRequest reports that the process is up, without talking to OPNsense.
+func handleHealthzRequest(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handleReadyzRequest reports whether the targets can be managed, answering 503 when they can't.
+func handleReadyzRequest(w http.ResponseWriter, r *http.Request) {
+	result := readiness.check(time.Now())
+	if !result.Ready {
+		writeJSON(w, http.StatusServiceUnavailable, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+// hostOverrideView is the JSON representation of an opnsense.HostOverride.
+type hostOverrideView struct {
+	UUID        string `json:"uuid"`
+	FQDN        string `json:"fqdn"`
+	Hostname    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Type        string `json:"type"`
+	Server      string `json:"server"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Managed     bool   `json:"managed"`
+}
+
+func newHostOverrideView(hostOverride opnsense.HostOverride) hostOverrideView {
+	return hostOverrideView{
+		UUID:        hostOverride.UUID,
+		FQDN:        hostOverride.GetFQDN(),
+		Hostname:    hostOverride.Hostname,
+		Domain:      hostOverride.Domain,
+		Type:        hostOverride.RecordType(),
+		Server:      hostOverride.Server,
+		Description: hostOverride.Description,
+		Enabled:     hostOverride.Enabled == "1",
+		Managed:     hostOverride.IsManaged(),
+	}
+}
+
+// aliasOverrideView is the JSON representation of an opnsense.AliasOverride.
+type aliasOverrideView struct {
+	UUID        string `json:"uuid"`
+	FQDN        string `json:"fqdn"`
+	Hostname    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Host        string `json:"host"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Managed     bool   `json:"managed"`
+}
+
+func newAliasOverrideView(aliasOverride opnsense.AliasOverride) aliasOverrideView {
+	return aliasOverrideView{
+		UUID:        aliasOverride.UUID,
+		FQDN:        aliasOverride.GetFQDN(),
+		Hostname:    aliasOverride.Hostname,
+		Domain:      aliasOverride.Domain,
+		Host:        aliasOverride.Host,
+		Description: aliasOverride.Description,
+		Enabled:     aliasOverride.Enabled == "1",
+		Managed:     aliasOverride.IsManaged(),
+	}
+}
+
+// hostView lists every host override record of a host, e.g. its A and AAAA record.
+type hostView struct {
+	FQDN    string             `json:"fqdn"`
+	Records []hostOverrideView `json:"records"`
+}
+
+// handleGetHostsRequest lists the host overrides the caller's token may manage.
+// With ?managed=true, only overrides created by OPNsenseProxyAPI are listed.
+// Like every GET request, it reads from the first target, or the one named in ?target=.
+func handleGetHostsRequest(w http.ResponseWriter, r *http.Request) {
+	managedOnly, err := parseBoolQuery(r, "managed")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	t, err := findTarget(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	hostOverrides, err := t.client.GetHostOverridesContext(r.Context())
+	if err != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while listing host overrides: %v", err)
+		writeJSON(w, upstreamStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+	views := []hostOverrideView{}
+	for _, hostOverride := range hostOverrides {
+		if managedOnly && !hostOverride.IsManaged() {
+			continue
+		}
+		if !isAuthorizedFor(r.Context(), canonicalFQDN(hostOverride.GetFQDN())) {
+			continue
+		}
+		views = append(views, newHostOverrideView(hostOverride))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func handleGetHostRequest(w http.ResponseWriter, r *http.Request) {
+	fqdn := canonicalFQDN(chi.URLParam(r, "fqdn"))
+	managedOnly, err := parseBoolQuery(r, "managed")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if !isAuthorizedFor(r.Context(), fqdn) {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: fmt.Sprintf("token is not allowed to manage %v", fqdn)})
+		return
+	}
+	t, err := findTarget(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	records, err := t.client.GetHostOverrideRecordsContext(r.Context(), fqdn)
+	if err != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while getting host override %v: %v", fqdn, err)
+		writeJSON(w, upstreamStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+	view := hostView{FQDN: fqdn, Records: []hostOverrideView{}}
+	for _, record := range records {
+		if managedOnly && !record.IsManaged() {
+			continue
+		}
+		view.Records = append(view.Records, newHostOverrideView(record))
+	}
+	if len(view.Records) == 0 {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("host override %v does not exist", fqdn)})
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func handleGetHostAliasesRequest(w http.ResponseWriter, r *http.Request) {
+	fqdn := canonicalFQDN(chi.URLParam(r, "fqdn"))
+	managedOnly, err := parseBoolQuery(r, "managed")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if !isAuthorizedFor(r.Context(), fqdn) {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: fmt.Sprintf("token is not allowed to manage %v", fqdn)})
+		return
+	}
+	t, err := findTarget(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	aliases, err := t.client.GetAliasOverridesForHostContext(r.Context(), fqdn)
+	if errors.Is(err, opnsense.ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while listing aliases of %v: %v", fqdn, err)
+		writeJSON(w, upstreamStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+	views := []aliasOverrideView{}
+	for _, alias := range aliases {
+		if managedOnly && !alias.IsManaged() {
+			continue
+		}
+		views = append(views, newAliasOverrideView(alias))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// deleteHostResponse reports what deleting a host removed from every target.
+type deleteHostResponse struct {
+	Host    string                `json:"host"`
+	Targets []*targetDeleteResult `json:"targets"`
+	Errors  []syncStepError       `json:"errors"`
+}
+
+// targetDeleteResult reports what deleting a host removed from one target. Processing of a target stops at its first error.
+type targetDeleteResult struct {
+	Target         string               `json:"target"`
+	HostOverrides  []hostOverrideChange `json:"hostOverrides"`
+	AliasesDeleted []string             `json:"aliasesDeleted"`
+	Reconfigured   bool                 `json:"reconfigured"`
+	// ReconfigurePending is set when the reconfiguration of Unbound is scheduled but did not happen yet
+	ReconfigurePending bool            `json:"reconfigurePending"`
+	Errors             []syncStepError `json:"errors"`
+}
+
+func newDeleteHostResponse(fqdn string) *deleteHostResponse {
+	return &deleteHostResponse{
+		Host:    fqdn,
+		Targets: []*targetDeleteResult{},
+		Errors:  []syncStepError{},
+	}
+}
+
+func (response *deleteHostResponse) addError(step string, err error) {
+	response.Errors = append(response.Errors, syncStepError{Step: step, Error: err.Error()})
+}
+
+func newTargetDeleteResult(name string) *targetDeleteResult {
+	return &targetDeleteResult{
+		Target:         name,
+		HostOverrides:  []hostOverrideChange{},
+		AliasesDeleted: []string{},
+		Errors:         []syncStepError{},
+	}
+}
+
+func (result *targetDeleteResult) addError(step string, err error) {
+	result.Errors = append(result.Errors, syncStepError{Step: step, Error: err.Error()})
+}
+
+func (result *targetDeleteResult) deletedAnything() bool {
+	return len(result.HostOverrides) > 0 || len(result.AliasesDeleted) > 0
+}
+
+// handleDeleteHostRequest deletes a host from every target. Targets without the host are skipped,
+// it is only reported as missing when no target has it.
+func handleDeleteHostRequest(w http.ResponseWriter, r *http.Request) {
+	fqdn := canonicalFQDN(chi.URLParam(r, "fqdn"))
+	r, logger := withHostLogger(r, fqdn)
+	response := newDeleteHostResponse(fqdn)
+	force, err := parseBoolQuery(r, "force")
+	if err != nil {
+		response.addError("validate", err)
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	}
+	wait, err := parseBoolQuery(r, "wait")
+	if err != nil {
+		response.addError("validate", err)
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	}
+	if _, _, failure := splitManagedFQDN(fqdn); failure != nil {
+		response.addError(failure.step, failure.err)
+		writeJSON(w, failure.status, response)
+		return
+	}
+	if !isAuthorizedFor(r.Context(), fqdn) {
+		logger.Warnf("Rejecting delete request for %v: token is not allowed to manage it", fqdn)
+		response.addError("authorize", fmt.Errorf("token is not allowed to manage %v", fqdn))
+		writeJSON(w, http.StatusForbidden, response)
+		return
+	}
+	failure := removeHost(r.Context(), fqdn, force, response, wait)
+	if failure != nil {
+		response.addError(failure.step, failure.err)
+		writeJSON(w, failure.status, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// removeHost deletes fqdn with its aliases from every target, recording the outcome in response, and removes its desired
+// state when that succeeded. Targets that do not know fqdn are skipped, unless no target knows it.
+func removeHost(ctx context.Context, fqdn string, force bool, response *deleteHostResponse, wait bool) *syncError {
+	logger := opnsense.Logger(ctx)
+	unlock, err := hostLocks.lock(ctx, fqdn)
+	if err != nil {
+		logger.Errorf("Error while waiting for a sync of %v: %v", fqdn, err)
+		return &syncError{step: "lock", status: upstreamStatus(err), err: err}
+	}
+	defer unlock()
+	for _, t := range targets {
+		response.Targets = append(response.Targets, newTargetDeleteResult(t.name))
+	}
+	deleteFailures := ignoreFailures(forEachTarget(func(i int, t *target) *syncError {
+		ctx := targetContext(ctx, t)
+		failure := deregisterHost(ctx, t.client, fqdn, force, response.Targets[i])
+		if failure != nil {
+			opnsense.Logger(ctx).Errorf("Error while deleting %v: %v", fqdn, failure)
+			response.Targets[i].addError(failure.step, failure.err)
+		}
+		return failure
+	}), http.StatusNotFound)
+	failure := combineFailures(deleteFailures)
+	if failure != nil {
+		return failure
+	}
+	err = store.Delete(fqdn)
+	if err != nil {
+		logger.Errorf("Error while removing desired state of %v: %v", fqdn, err)
+	}
+	unlock()
+	failures := forEachTarget(func(i int, t *target) *syncError {
+		result := response.Targets[i]
+		if deleteFailures[i] != nil {
+			return deleteFailures[i]
+		}
+		var failure *syncError
+		result.Reconfigured, result.ReconfigurePending, failure = awaitReconfigure(ctx, t.scheduler, result.Reconfigured, wait)
+		if failure != nil {
+			opnsense.Logger(targetContext(ctx, t)).Errorf("Error while waiting for Unbound to reconfigure after deleting %v: %v", fqdn, failure)
+			result.addError(failure.step, failure.err)
+		}
+		return failure
+	})
+	return combineFailures(failures)
+}
+
+// deregisterHost deletes every alias of fqdn, then its host overrides, and reconfigures Unbound once.
+func deregisterHost(ctx context.Context, client opnsense.Client, fqdn string, force bool, result *targetDeleteResult) *syncError {
+	failure := deleteHost(ctx, client, fqdn, force, result)
+	if failure != nil {
+		return failure
+	}
+	err := client.ReconfigureContext(ctx)
+	if err != nil {
+		return &syncError{step: "reconfigure", status: upstreamStatus(err), err: err}
+	}
+	result.Reconfigured = true
+	return nil
+}
+
+// deleteHost deletes every alias of fqdn, then its host overrides, without reconfiguring Unbound.
+// Unless force is set, nothing is deleted when one of the overrides was not created by OPNsenseProxyAPI.
+func deleteHost(ctx context.Context, client opnsense.Client, fqdn string, force bool, result *targetDeleteResult) *syncError {
+	records, err := client.GetHostOverrideRecordsContext(ctx, fqdn)
+	if err != nil {
+		return &syncError{step: "getHostOverrides", status: upstreamStatus(err), err: err}
+	}
+	if len(records) == 0 {
+		return &syncError{step: "getHostOverrides", status: http.StatusNotFound, err: fmt.Errorf("host override %v does not exist", fqdn)}
+	}
+	aliases, err := client.GetAliasOverridesForHostContext(ctx, fqdn)
+	if err != nil {
+		return &syncError{step: "getAliasOverrides", status: upstreamStatus(err), err: err}
+	}
+	if !force {
+		for _, record := range records {
+			if !record.IsManaged() {
+				return &syncError{step: "validate", status: http.StatusConflict, err: fmt.Errorf("%v host override %v was not created by OPNsenseProxyAPI", record.RecordType(), fqdn)}
+			}
+		}
+		for _, alias := range aliases {
+			if !alias.IsManaged() {
+				return &syncError{step: "validate", status: http.StatusConflict, err: fmt.Errorf("alias override %v was not created by OPNsenseProxyAPI", alias.GetFQDN())}
+			}
+		}
+	}
+	opnsense.Logger(ctx).Infof("Deleting host %v with %v host overrides and %v aliases", fqdn, len(records), len(aliases))
+	for _, alias := range aliases {
+		_, err = client.DeleteAliasOverrideRecordContext(ctx, alias)
+		if err != nil {
+			return &syncError{step: "deleteAliasOverride", status: upstreamStatus(err), err: err}
+		}
+		result.AliasesDeleted = append(result.AliasesDeleted, alias.GetFQDN())
+		aliasesDeletedTotal.Inc()
+	}
+	for _, record := range records {
+		_, err = client.DeleteHostOverrideRecordContext(ctx, record)
+		if err != nil {
+			return &syncError{step: "deleteHostOverride", status: upstreamStatus(err), err: err}
+		}
+		result.HostOverrides = append(result.HostOverrides, hostOverrideChange{Type: record.RecordType(), Server: record.Server, Action: hostOverrideDeleted})
+	}
+	return nil
+}
+
+// checkUnmanagedRecords fails if a target has a host or alias override of fqdn that was not created by
+// OPNsenseProxyAPI, so providers like the Kubernetes controller don't take over records made by hand. A sync would
+// otherwise overwrite such a record and its deletion would fail forever.
+func checkUnmanagedRecords(ctx context.Context, fqdn string) *syncError {
+	failures := forEachTarget(func(i int, t *target) *syncError {
+		ctx := targetContext(ctx, t)
+		records, err := t.client.GetHostOverrideRecordsContext(ctx, fqdn)
+		if err != nil {
+			return &syncError{step: "getHostOverrides", status: upstreamStatus(err), err: err}
+		}
+		for _, record := range records {
+			if !record.IsManaged() {
+				return &syncError{step: "validate", status: http.StatusConflict, err: fmt.Errorf("%v host override %v was not created by OPNsenseProxyAPI", record.RecordType(), fqdn)}
+			}
+		}
+		aliases, err := t.client.GetAliasOverridesContext(ctx)
+		if err != nil {
+			return &syncError{step: "getAliasOverrides", status: upstreamStatus(err), err: err}
+		}
+		for _, alias := range aliases {
+			if alias.GetFQDN() == fqdn && !alias.IsManaged() {
+				return &syncError{step: "validate", status: http.StatusConflict, err: fmt.Errorf("alias override %v was not created by OPNsenseProxyAPI", fqdn)}
+			}
+		}
+		return nil
+	})
+	// unlike combineFailures, an unmanaged record on any target rejects the change
+	for i, failure := range failures {
+		if failure != nil {
+			return &syncError{step: failure.step, status: failure.status, err: fmt.Errorf("target %v: %w", targets[i].name, failure.err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serviceAccountDir holds the token and CA of the service account of a pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Config is the API server to connect to and the credentials to use.
+type Config struct {
+	URL string
+	// TokenFile holds a bearer token. It is read for every request, so rotated tokens are picked up.
+	TokenFile string
+	// CAFile holds the PEM encoded CA of the API server. The system roots are used when it is empty.
+	CAFile string
+}
+
+// InClusterConfig returns the Config of the API server for a pod, using the token of its service account.
+func InClusterConfig() (Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return Config{}, errors.New("not running in a cluster: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set")
+	}
+	return Config{
+		URL:       "https://" + net.JoinHostPort(host, port),
+		TokenFile: serviceAccountDir + "/token",
+		CAFile:    serviceAccountDir + "/ca.crt",
+	}, nil
+}
+
+// Resource is a kind of object served by the API server, e.g. Ingresses.
+type Resource struct {
+	Group   string
+	Version string
+	Plural  string
+}
+
+var (
+	Ingresses  = Resource{Group: "networking.k8s.io", Version: "v1", Plural: "ingresses"}
+	HTTPRoutes = Resource{Group: "gateway.networking.k8s.io", Version: "v1", Plural: "httproutes"}
+	Gateways   = Resource{Group: "gateway.networking.k8s.io", Version: "v1", Plural: "gateways"}
+)
+
+func (r Resource) String() string {
+	return r.Plural + "." + r.Group
+}
+
+// path returns the path of the objects of r in namespace, or in every namespace if it is empty, or of the object name.
+func (r Resource) path(namespace, name string) string {
+	path := "/apis/" + r.Group + "/" + r.Version
+	if namespace != "" {
+		path += "/namespaces/" + namespace
+	}
+	path += "/" + r.Plural
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// StatusError is an error answered by the API server.
+type StatusError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v %v", e.Code, http.StatusText(e.Code))
+	}
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404, e.g. of a resource whose CustomResourceDefinition is not installed.
+func IsNotFound(err error) bool {
+	var statusError *StatusError
+	return errors.As(err, &statusError) && statusError.Code == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 of an object that was changed since it was read.
+func IsConflict(err error) bool {
+	var statusError *StatusError
+	return errors.As(err, &statusError) && statusError.Code == http.StatusConflict
+}
+
+// WatchEvent is a change of an object, e.g. "ADDED", "MODIFIED" or "DELETED".
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Client reads and watches objects through the Kubernetes API, and changes their finalizers and annotations.
+type Client struct {
+	client *resty.Client
+}
+
+func NewClient(config Config) (*Client, error) {
+	if config.URL == "" {
+		return nil, errors.New("no API server URL")
+	}
+	client := resty.New().SetBaseURL(strings.TrimSuffix(config.URL, "/"))
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %v", config.CAFile)
+		}
+		client.SetTLSClientConfig(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+	}
+	if config.TokenFile != "" {
+		client.OnBeforeRequest(func(_ *resty.Client, request *resty.Request) error {
+			token, err := os.ReadFile(config.TokenFile)
+			if err != nil {
+				return fmt.Errorf("reading token: %w", err)
+			}
+			request.SetAuthToken(strings.TrimSpace(string(token)))
+			return nil
+		})
+	}
+	return &Client{client: client}, nil
+}
+
+// objectList is a page of objects as listed by the API server.
+type objectList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []Object `json:"items"`
+}
+
+// List lists the objects of resource in namespace, or in every namespace if it is empty.
+func (c *Client) List(ctx context.Context, resource Resource, namespace string) ([]Object, error) {
+	var objects []Object
+	next := ""
+	for {
+		var list objectList
+		request := c.client.R().
+			SetContext(ctx).
+			SetQueryParam("limit", "500").
+			SetResult(&list)
+		if next != "" {
+			request.SetQueryParam("continue", next)
+		}
+		resp, err := request.Get(resource.path(namespace, ""))
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return nil, statusError(resp)
+		}
+		objects = append(objects, list.Items...)
+		next = list.Metadata.Continue
+		if next == "" {
+			return objects, nil
+		}
+	}
+}
+
+// Get reads the object name of resource in namespace.
+func (c *Client) Get(ctx context.Context, resource Resource, namespace, name string) (Object, error) {
+	var object Object
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetResult(&object).
+		Get(resource.path(namespace, name))
+	if err != nil {
+		return Object{}, err
+	}
+	if resp.IsError() {
+		return Object{}, statusError(resp)
+	}
+	return object, nil
+}
+
+// Watch streams the changes of the objects of resource in namespace, or in every namespace if it is empty, to handle
+// until ctx is done or the API server ends the stream. The stream starts with an "ADDED" event for every object.
+func (c *Client) Watch(ctx context.Context, resource Resource, namespace string, handle func(WatchEvent)) error {
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetQueryParam("watch", "true").
+		SetDoNotParseResponse(true).
+		Get(resource.path(namespace, ""))
+	if err != nil {
+		return err
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.IsError() {
+		statusErr := &StatusError{}
+		_ = json.NewDecoder(body).Decode(statusErr)
+		statusErr.Code = resp.StatusCode()
+		return statusErr
+	}
+	decoder := json.NewDecoder(body)
+	for {
+		var event WatchEvent
+		err := decoder.Decode(&event)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("decoding watch event: %w", err)
+		}
+		if event.Type == "ERROR" {
+			statusErr := &StatusError{}
+			_ = json.Unmarshal(event.Object, statusErr)
+			return statusErr
+		}
+		handle(event)
+	}
+}
+
+// metadataPatch is a JSON merge patch of the finalizers and annotations of an object. It carries the resourceVersion
+// of the object as read, so the API server rejects it with a conflict when the object was changed in between.
+type metadataPatch struct {
+	Metadata struct {
+		ResourceVersion string             `json:"resourceVersion"`
+		Finalizers      []string           `json:"finalizers"`
+		Annotations     map[string]*string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+}
+
+// PatchMetadata replaces the finalizers of object and sets annotations, removing those set to nil.
+// It fails with a conflict, see IsConflict, when object was changed since it was read.
+func (c *Client) PatchMetadata(ctx context.Context, resource Resource, object Object, finalizers []string, annotations map[string]*string) (Object, error) {
+	var patch metadataPatch
+	patch.Metadata.ResourceVersion = object.Metadata.ResourceVersion
+	patch.Metadata.Finalizers = finalizers
+	if patch.Metadata.Finalizers == nil {
+		patch.Metadata.Finalizers = []string{}
+	}
+	patch.Metadata.Annotations = annotations
+	var patched Object
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/merge-patch+json").
+		SetBody(patch).
+		SetResult(&patched).
+		Patch(resource.path(object.Metadata.Namespace, object.Metadata.Name))
+	if err != nil {
+		return Object{}, err
+	}
+	if resp.IsError() {
+		return Object{}, statusError(resp)
+	}
+	return patched, nil
+}
+
+// statusError reads the Status the API server answers with on errors.
+func statusError(resp *resty.Response) error {
+	statusErr := &StatusError{}
+	_ = json.Unmarshal(resp.Body(), statusErr)
+	statusErr.Code = resp.StatusCode()
+	return statusErr
+}
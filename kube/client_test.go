@@ -0,0 +1,161 @@
+package kube
+
+import (
+	"OPNsenseProxyAPI/kube/kubetest"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	ingressResource = "networking.k8s.io/v1/ingresses"
+	app1Ingress     = `{
+  "metadata": {"name": "app1", "namespace": "default"},
+  "spec": {"rules": [{"host": "App1.example.com"}, {"host": "*.example.com"}, {"http": {}}]},
+  "status": {"loadBalancer": {"ingress": [{"ip": "10.0.0.20"}, {"hostname": "lb.example.com"}]}}
+}`
+)
+
+func newTestServer(t *testing.T) (*kubetest.Server, *Client) {
+	server := kubetest.NewServer()
+	t.Cleanup(server.Close)
+	server.Token = "token1"
+	server.AddResource(ingressResource)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token1\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	client, err := NewClient(Config{URL: server.URL, TokenFile: tokenFile})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return server, client
+}
+
+func TestObject(t *testing.T) {
+	tests := []struct {
+		name          string
+		object        string
+		wantHosts     []string
+		wantAddresses []string
+	}{
+		{name: "ingress", object: app1Ingress, wantHosts: []string{"app1.example.com"}, wantAddresses: []string{"10.0.0.20"}},
+		{
+			name:      "httproute",
+			object:    `{"spec": {"hostnames": ["app2.example.com", "app1.example.com", "app2.example.com"], "parentRefs": [{"name": "gateway1"}]}}`,
+			wantHosts: []string{"app1.example.com", "app2.example.com"},
+		},
+		{
+			name:          "gateway",
+			object:        `{"status": {"addresses": [{"type": "IPAddress", "value": "10.0.0.21"}, {"value": "fd00::21"}, {"type": "Hostname", "value": "gw.example.com"}]}}`,
+			wantAddresses: []string{"10.0.0.21", "fd00::21"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var object Object
+			if err := json.Unmarshal([]byte(tt.object), &object); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if got := object.Hosts(); !reflect.DeepEqual(got, tt.wantHosts) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.wantHosts)
+			}
+			if got := object.Addresses(); !reflect.DeepEqual(got, tt.wantAddresses) {
+				t.Errorf("Addresses() = %v, want %v", got, tt.wantAddresses)
+			}
+		})
+	}
+}
+
+func TestClient(t *testing.T) {
+	server, client := newTestServer(t)
+	if err := server.Apply(ingressResource, app1Ingress); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	ctx := context.Background()
+
+	objects, err := client.List(ctx, Ingresses, "")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key() != "default/app1" {
+		t.Fatalf("List() got %+v, want default/app1", objects)
+	}
+	if _, err := client.List(ctx, HTTPRoutes, ""); !IsNotFound(err) {
+		t.Errorf("List() of resource that is not served error = %v, want not found", err)
+	}
+
+	hosts := "app1.example.com"
+	patched, err := client.PatchMetadata(ctx, Ingresses, objects[0], []string{"example.com/finalizer"}, map[string]*string{"example.com/hosts": &hosts})
+	if err != nil {
+		t.Fatalf("PatchMetadata() error = %v", err)
+	}
+	if !patched.HasFinalizer("example.com/finalizer") || patched.Metadata.Annotations["example.com/hosts"] != hosts {
+		t.Errorf("PatchMetadata() got %+v, want finalizer and annotation", patched.Metadata)
+	}
+	if _, err := client.PatchMetadata(ctx, Ingresses, objects[0], nil, nil); !IsConflict(err) {
+		t.Errorf("PatchMetadata() of outdated object error = %v, want conflict", err)
+	}
+
+	server.Delete(ingressResource, "default", "app1")
+	deleting, err := client.Get(ctx, Ingresses, "default", "app1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !deleting.IsDeleting() {
+		t.Errorf("Get() of object with finalizer after delete got %+v, want deleting", deleting.Metadata)
+	}
+	if _, err := client.PatchMetadata(ctx, Ingresses, deleting, nil, map[string]*string{"example.com/hosts": nil}); err != nil {
+		t.Fatalf("PatchMetadata() error = %v", err)
+	}
+	if _, err := client.Get(ctx, Ingresses, "default", "app1"); !IsNotFound(err) {
+		t.Errorf("Get() after removing the finalizer error = %v, want not found", err)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	server, client := newTestServer(t)
+	if err := server.Apply(ingressResource, app1Ingress); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan WatchEvent, 3)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Watch(ctx, Ingresses, "default", func(event WatchEvent) { events <- event })
+	}()
+	for server.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := server.Apply(ingressResource, `{"metadata": {"name": "app2", "namespace": "other"}}`); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	server.Delete(ingressResource, "default", "app1")
+
+	for _, wantType := range []string{"ADDED", "DELETED"} {
+		select {
+		case event := <-events:
+			var object Object
+			if err := json.Unmarshal(event.Object, &object); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if event.Type != wantType || object.Key() != "default/app1" {
+				t.Errorf("Watch() got %v of %v, want %v of default/app1", event.Type, object.Key(), wantType)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Watch() got no %v event", wantType)
+		}
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Watch() error = %v, want %v", err, context.Canceled)
+	}
+	if err := client.Watch(context.Background(), HTTPRoutes, "", func(WatchEvent) {}); !IsNotFound(err) {
+		t.Errorf("Watch() of resource that is not served error = %v, want not found", err)
+	}
+}
@@ -0,0 +1,350 @@
+// Package kubetest provides an in-memory stand-in for the parts of the Kubernetes API used by the kube package, so that
+// the Kubernetes controller can be tested without a cluster. Finalizers are honored: deleting an object with finalizers
+// only marks it as deleting until they are removed.
+package kubetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata is the metadata of a stored object.
+type Metadata struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	DeletionTimestamp *time.Time        `json:"deletionTimestamp,omitempty"`
+	Finalizers        []string          `json:"finalizers,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+}
+
+type object struct {
+	Metadata Metadata        `json:"metadata"`
+	Spec     json.RawMessage `json:"spec,omitempty"`
+	Status   json.RawMessage `json:"status,omitempty"`
+}
+
+type event struct {
+	Type   string `json:"type"`
+	Object object `json:"object"`
+}
+
+type subscription struct {
+	resource  string
+	namespace string
+}
+
+// Server serves list, get, watch and merge patch of metadata for the resources added with AddResource.
+type Server struct {
+	URL string
+	// Token is the bearer token requests must carry, if set.
+	Token string
+
+	server      *httptest.Server
+	done        chan struct{}
+	mu          sync.Mutex
+	version     int
+	objects     map[string]map[string]object
+	subscribers map[chan event]subscription
+}
+
+// NewServer starts a Server without resources. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		done:        make(chan struct{}),
+		objects:     make(map[string]map[string]object),
+		subscribers: make(map[chan event]subscription),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close ends every watch and stops the server.
+func (s *Server) Close() {
+	close(s.done)
+	s.server.Close()
+}
+
+// AddResource serves resource, given as "group/version/plural", e.g. "networking.k8s.io/v1/ingresses".
+// Other resources are answered with 404, like resources whose CustomResourceDefinition is not installed.
+func (s *Server) AddResource(resource string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects[resource] == nil {
+		s.objects[resource] = make(map[string]object)
+	}
+}
+
+// Apply creates or updates an object of resource from its JSON. The spec and status are replaced, while the
+// finalizers, annotations and deletion timestamp of an existing object are kept.
+func (s *Server) Apply(resource, objectJSON string) error {
+	var o object
+	if err := json.Unmarshal([]byte(objectJSON), &o); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := o.Metadata.Namespace + "/" + o.Metadata.Name
+	eventType := "ADDED"
+	if existing, found := s.objects[resource][key]; found {
+		o.Metadata.Finalizers = existing.Metadata.Finalizers
+		o.Metadata.Annotations = existing.Metadata.Annotations
+		o.Metadata.DeletionTimestamp = existing.Metadata.DeletionTimestamp
+		eventType = "MODIFIED"
+	}
+	s.store(resource, o, eventType)
+	return nil
+}
+
+// Delete deletes an object of resource, or marks it as deleting if it has finalizers.
+func (s *Server) Delete(resource, namespace, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, found := s.objects[resource][namespace+"/"+name]
+	if !found {
+		return
+	}
+	if len(o.Metadata.Finalizers) == 0 {
+		s.remove(resource, o)
+		return
+	}
+	if o.Metadata.DeletionTimestamp == nil {
+		now := time.Now().UTC().Truncate(time.Second)
+		o.Metadata.DeletionTimestamp = &now
+		s.store(resource, o, "MODIFIED")
+	}
+}
+
+// Get returns the metadata of an object of resource.
+func (s *Server) Get(resource, namespace, name string) (Metadata, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, found := s.objects[resource][namespace+"/"+name]
+	return o.Metadata, found
+}
+
+// Subscribers returns the number of open watches.
+func (s *Server) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+func (s *Server) store(resource string, o object, eventType string) object {
+	s.version++
+	o.Metadata.ResourceVersion = strconv.Itoa(s.version)
+	s.objects[resource][o.Metadata.Namespace+"/"+o.Metadata.Name] = o
+	s.publish(resource, event{Type: eventType, Object: o})
+	return o
+}
+
+func (s *Server) remove(resource string, o object) {
+	delete(s.objects[resource], o.Metadata.Namespace+"/"+o.Metadata.Name)
+	s.publish(resource, event{Type: "DELETED", Object: o})
+}
+
+func (s *Server) publish(resource string, e event) {
+	for subscriber, sub := range s.subscribers {
+		if sub.resource == resource && (sub.namespace == "" || sub.namespace == e.Object.Metadata.Namespace) {
+			subscriber <- e
+		}
+	}
+}
+
+// parsePath splits /apis/GROUP/VERSION[/namespaces/NAMESPACE]/PLURAL[/NAME].
+func parsePath(path string) (resource, namespace, name string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/apis/"), "/")
+	if len(parts) < 3 || !strings.HasPrefix(path, "/apis/") {
+		return "", "", "", false
+	}
+	group, version, rest := parts[0], parts[1], parts[2:]
+	if len(rest) >= 3 && rest[0] == "namespaces" {
+		namespace, rest = rest[1], rest[2:]
+	}
+	switch len(rest) {
+	case 1:
+	case 2:
+		name = rest[1]
+	default:
+		return "", "", "", false
+	}
+	return group + "/" + version + "/" + rest[0], namespace, name, true
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	resource, namespace, name, ok := parsePath(r.URL.Path)
+	s.mu.Lock()
+	_, served := s.objects[resource]
+	s.mu.Unlock()
+	if !ok || !served {
+		writeStatus(w, http.StatusNotFound, "the server could not find the requested resource")
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && name == "" && r.URL.Query().Get("watch") == "true":
+		s.watch(w, r, resource, namespace)
+	case r.Method == http.MethodGet && name == "":
+		s.list(w, resource, namespace)
+	case r.Method == http.MethodGet:
+		s.get(w, resource, namespace, name)
+	case r.Method == http.MethodPatch && name != "":
+		s.patch(w, r, resource, namespace, name)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// sorted returns the objects of resource in namespace, or in every namespace if it is empty, sorted by key.
+func (s *Server) sorted(resource, namespace string) []object {
+	objects := []object{}
+	for _, o := range s.objects[resource] {
+		if namespace == "" || o.Metadata.Namespace == namespace {
+			objects = append(objects, o)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Metadata.Namespace+"/"+objects[i].Metadata.Name < objects[j].Metadata.Namespace+"/"+objects[j].Metadata.Name
+	})
+	return objects
+}
+
+func (s *Server) list(w http.ResponseWriter, resource, namespace string) {
+	s.mu.Lock()
+	list := map[string]any{
+		"metadata": map[string]string{"resourceVersion": strconv.Itoa(s.version)},
+		"items":    s.sorted(resource, namespace),
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) get(w http.ResponseWriter, resource, namespace, name string) {
+	s.mu.Lock()
+	o, found := s.objects[resource][namespace+"/"+name]
+	s.mu.Unlock()
+	if !found {
+		writeStatus(w, http.StatusNotFound, name+" not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+// patch applies a JSON merge patch of the finalizers and annotations, rejecting it if its resourceVersion is outdated.
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, resource, namespace, name string) {
+	if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+		writeStatus(w, http.StatusUnsupportedMediaType, "unsupported patch type")
+		return
+	}
+	var patch struct {
+		Metadata struct {
+			ResourceVersion string             `json:"resourceVersion"`
+			Finalizers      *[]string          `json:"finalizers"`
+			Annotations     map[string]*string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, found := s.objects[resource][namespace+"/"+name]
+	if !found {
+		writeStatus(w, http.StatusNotFound, name+" not found")
+		return
+	}
+	if patch.Metadata.ResourceVersion != "" && patch.Metadata.ResourceVersion != o.Metadata.ResourceVersion {
+		writeStatus(w, http.StatusConflict, "the object has been modified; please apply your changes to the latest version and try again")
+		return
+	}
+	if patch.Metadata.Finalizers != nil {
+		o.Metadata.Finalizers = *patch.Metadata.Finalizers
+	}
+	annotations := make(map[string]string)
+	for key, value := range o.Metadata.Annotations {
+		annotations[key] = value
+	}
+	for key, value := range patch.Metadata.Annotations {
+		if value == nil {
+			delete(annotations, key)
+		} else {
+			annotations[key] = *value
+		}
+	}
+	o.Metadata.Annotations = annotations
+	if o.Metadata.DeletionTimestamp != nil && len(o.Metadata.Finalizers) == 0 {
+		s.remove(resource, o)
+	} else {
+		o = s.store(resource, o, "MODIFIED")
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, resource, namespace string) {
+	// buffered, so that publishing does not block while the watch writes
+	events := make(chan event, 64)
+	s.mu.Lock()
+	initial := s.sorted(resource, namespace)
+	s.subscribers[events] = subscription{resource: resource, namespace: namespace}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, events)
+		s.mu.Unlock()
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for _, o := range initial {
+		if err := encoder.Encode(event{Type: "ADDED", Object: o}); err != nil {
+			return
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case e := <-events:
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// writeStatus answers with a Status, as the API server does on errors.
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]any{
+		"kind":    "Status",
+		"status":  "Failure",
+		"message": message,
+		"reason":  strings.ReplaceAll(http.StatusText(code), " ", ""),
+		"code":    code,
+	})
+}
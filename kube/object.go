@@ -0,0 +1,130 @@
+package kube
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Object holds the fields of Ingresses, HTTPRoutes and Gateways that are needed to find their hosts and addresses.
+type Object struct {
+	Metadata ObjectMeta   `json:"metadata"`
+	Spec     ObjectSpec   `json:"spec"`
+	Status   ObjectStatus `json:"status"`
+}
+
+type ObjectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	DeletionTimestamp *time.Time        `json:"deletionTimestamp,omitempty"`
+	Finalizers        []string          `json:"finalizers,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+}
+
+type ObjectSpec struct {
+	// Rules are the rules of an Ingress.
+	Rules []IngressRule `json:"rules,omitempty"`
+	// Hostnames are the hostnames of an HTTPRoute.
+	Hostnames []string `json:"hostnames,omitempty"`
+	// ParentRefs are the Gateways of an HTTPRoute.
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+}
+
+type IngressRule struct {
+	Host string `json:"host"`
+}
+
+// ParentReference refers to a Gateway unless Group or Kind say otherwise. Namespace defaults to that of the route.
+type ParentReference struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// IsGateway reports whether the parent is a Gateway.
+func (ref ParentReference) IsGateway() bool {
+	return (ref.Group == "" || ref.Group == Gateways.Group) && (ref.Kind == "" || ref.Kind == "Gateway")
+}
+
+type ObjectStatus struct {
+	// LoadBalancer is the load balancer of an Ingress.
+	LoadBalancer LoadBalancerStatus `json:"loadBalancer"`
+	// Addresses are the addresses of a Gateway.
+	Addresses []GatewayAddress `json:"addresses,omitempty"`
+}
+
+type LoadBalancerStatus struct {
+	Ingress []LoadBalancerIngress `json:"ingress,omitempty"`
+}
+
+type LoadBalancerIngress struct {
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+type GatewayAddress struct {
+	// Type is "IPAddress" if empty.
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value"`
+}
+
+// Key returns "namespace/name".
+func (o Object) Key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// IsDeleting reports whether the object is deleted once its finalizers are removed.
+func (o Object) IsDeleting() bool {
+	return o.Metadata.DeletionTimestamp != nil
+}
+
+// HasFinalizer reports whether finalizer is one of the finalizers of the object.
+func (o Object) HasFinalizer(finalizer string) bool {
+	for _, f := range o.Metadata.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts returns the sorted hostnames of the rules of an Ingress or of an HTTPRoute. Wildcards are skipped.
+func (o Object) Hosts() []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	add := func(host string) {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" || seen[host] || strings.Contains(host, "*") {
+			return
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	for _, rule := range o.Spec.Rules {
+		add(rule.Host)
+	}
+	for _, hostname := range o.Spec.Hostnames {
+		add(hostname)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Addresses returns the IP addresses of the load balancer of an Ingress or of a Gateway. Hostnames are skipped.
+func (o Object) Addresses() []string {
+	var addresses []string
+	for _, ingress := range o.Status.LoadBalancer.Ingress {
+		if net.ParseIP(ingress.IP) != nil {
+			addresses = append(addresses, ingress.IP)
+		}
+	}
+	for _, address := range o.Status.Addresses {
+		if (address.Type == "" || address.Type == "IPAddress") && net.ParseIP(address.Value) != nil {
+			addresses = append(addresses, address.Value)
+		}
+	}
+	return addresses
+}
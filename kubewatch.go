@@ -0,0 +1,480 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/kube"
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kubeFinalizer keeps deleted Ingresses and HTTPRoutes until their hosts are removed from OPNsense.
+	kubeFinalizer = "opnsense-proxy-api/dns"
+	// kubeHostsAnnotation lists the hosts that may have host overrides for an object, so they are deleted with it.
+	kubeHostsAnnotation = "opnsense-proxy-api/hosts"
+	// kubeOwner owns the hosts synced by the controller, see desiredHost.
+	kubeOwner = "kubernetes"
+)
+
+// kubeResources are the watched resources. HTTPRoutes are skipped while the Gateway API is not installed.
+var kubeResources = []kube.Resource{kube.Ingresses, kube.HTTPRoutes}
+
+// kubeController syncs the hosts of Ingresses and HTTPRoutes whenever they change and every resyncInterval.
+// With WATCH_HOST, every host becomes an alias of it, like the aliases found by the other watchers. Without it, every
+// host gets host overrides for the load balancer addresses of its Ingress, or of the Gateways of its HTTPRoute.
+// Objects with hosts get kubeFinalizer, so their hosts are removed before they are deleted.
+type kubeController struct {
+	client         *kube.Client
+	namespace      string
+	resyncInterval time.Duration
+	timeout        time.Duration
+	retryInterval  time.Duration
+	// watcher is nil without WATCH_HOST. It does not discover aliases itself.
+	watcher *aliasWatcher
+	// missing are the resources that are not served, so they are warned about once
+	missing map[kube.Resource]bool
+	// skipped are the hosts outside the managed domains that were already warned about
+	skipped map[string]bool
+	// conflicts are the hosts synced by someone else or with records made by hand that were already warned about
+	conflicts map[string]bool
+}
+
+// kubeObject is an Ingress or an HTTPRoute.
+type kubeObject struct {
+	resource kube.Resource
+	kube.Object
+}
+
+func newKubeController(cfg watchConfig) (*kubeController, error) {
+	kubeConfig := kube.Config{URL: cfg.Kubernetes.APIURL, TokenFile: cfg.Kubernetes.TokenFile, CAFile: cfg.Kubernetes.CAFile}
+	var err error
+	if kubeConfig.URL == "" {
+		kubeConfig, err = kube.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("KUBE_API_URL not set and %w", err)
+		}
+	}
+	client, err := kube.NewClient(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	resyncInterval, err := parseDuration(cfg.Kubernetes.ResyncInterval, 5*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("parsing KUBE_RESYNC_INTERVAL: %w", err)
+	}
+	if resyncInterval <= 0 {
+		return nil, errors.New("KUBE_RESYNC_INTERVAL must be positive")
+	}
+	c := &kubeController{
+		client:         client,
+		namespace:      cfg.Kubernetes.Namespace,
+		resyncInterval: resyncInterval,
+		timeout:        5 * time.Minute,
+		retryInterval:  10 * time.Second,
+		missing:        make(map[kube.Resource]bool),
+		skipped:        make(map[string]bool),
+		conflicts:      make(map[string]bool),
+	}
+	if cfg.Host != "" || len(cfg.Addresses) > 0 {
+		c.watcher, err = newAliasWatcher(kubeOwner, cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Run syncs the hosts of every object and follows their changes until ctx is done.
+func (c *kubeController) Run(ctx context.Context) {
+	trigger := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for _, resource := range kubeResources {
+		wg.Add(1)
+		go func(resource kube.Resource) {
+			defer wg.Done()
+			c.watch(ctx, resource, trigger)
+		}(resource)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		notifyEvery(ctx, c.resyncInterval, trigger)
+	}()
+	if c.watcher != nil {
+		log.Infof("Syncing the hosts of Ingresses and HTTPRoutes as aliases of %v", c.watcher.host)
+	} else {
+		log.Infof("Syncing the hosts of Ingresses and HTTPRoutes with the addresses of their load balancers")
+	}
+	runSyncs(ctx, "the hosts of Ingresses and HTTPRoutes", trigger, c.retryInterval, c.sync)
+	wg.Wait()
+}
+
+// watch fires trigger for every change of the objects of resource until ctx is done. The watch is reopened when the
+// API server ends it, and after a delay when it fails.
+func (c *kubeController) watch(ctx context.Context, resource kube.Resource, trigger chan<- struct{}) {
+	for {
+		err := c.client.Watch(ctx, resource, c.namespace, func(event kube.WatchEvent) {
+			notify(trigger)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		delay := time.Duration(0)
+		if err != nil {
+			if !kube.IsNotFound(err) {
+				log.Errorf("Error while watching %v: %v", resource, err)
+			}
+			delay = c.retryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// sync lists the objects and syncs their hosts.
+func (c *kubeController) sync(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	ctx = opnsense.WithLogger(ctx, opnsense.Logger(ctx).WithField("source", "kubernetes"))
+	objects, err := c.list(ctx)
+	if err != nil {
+		return err
+	}
+	if c.watcher != nil {
+		return c.syncAliases(ctx, objects)
+	}
+	return c.syncHosts(ctx, objects)
+}
+
+// list lists the objects of every resource that is served, sorted by resource and key.
+func (c *kubeController) list(ctx context.Context) ([]*kubeObject, error) {
+	var objects []*kubeObject
+	for _, resource := range kubeResources {
+		list, err := c.client.List(ctx, resource, c.namespace)
+		if kube.IsNotFound(err) {
+			if !c.missing[resource] {
+				opnsense.Logger(ctx).Warnf("Skipping %v: not served by the API server", resource)
+				c.missing[resource] = true
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing %v: %w", resource, err)
+		}
+		delete(c.missing, resource)
+		sort.Slice(list, func(i, j int) bool { return list[i].Key() < list[j].Key() })
+		for _, object := range list {
+			objects = append(objects, &kubeObject{resource: resource, Object: object})
+		}
+	}
+	return objects, nil
+}
+
+// syncAliases syncs the hosts of every object that is not being deleted as aliases of the watched host, then releases
+// the objects being deleted, whose hosts are no aliases anymore.
+func (c *kubeController) syncAliases(ctx context.Context, objects []*kubeObject) error {
+	var hosts []string
+	for _, object := range objects {
+		if object.IsDeleting() || len(object.Hosts()) == 0 {
+			continue
+		}
+		err := c.claim(ctx, object, nil)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, object.Hosts()...)
+	}
+	err := c.watcher.syncAliases(ctx, hosts)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, object := range objects {
+		if object.IsDeleting() && object.HasFinalizer(kubeFinalizer) {
+			errs = append(errs, c.release(ctx, object))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncHosts syncs the host overrides of the hosts of every object that is not being deleted, then removes the hosts
+// objects no longer have and releases the objects being deleted. Hosts of objects whose load balancer has no address
+// yet are neither synced nor removed.
+func (c *kubeController) syncHosts(ctx context.Context, objects []*kubeObject) error {
+	logger := opnsense.Logger(ctx)
+	var errs []error
+	desired := make(map[string][]string)
+	owners := make(map[string]string)
+	kept := make(map[string]bool)
+	gateways := make(map[string][]string)
+	for _, object := range objects {
+		hosts := c.managedHosts(ctx, object)
+		if object.IsDeleting() || len(hosts) == 0 {
+			continue
+		}
+		// the hosts are recorded before they are synced, so they are removed with the object even if it is deleted meanwhile
+		err := c.claim(ctx, object, hosts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addresses, err := c.addresses(ctx, object, gateways)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, host := range hosts {
+			kept[host] = true
+			if len(addresses) == 0 {
+				continue
+			}
+			if owner, found := owners[host]; found {
+				logger.Debugf("Skipping %v of %v %v: already synced for %v", host, object.resource, object.Key(), owner)
+				continue
+			}
+			desired[host] = addresses
+			owners[host] = fmt.Sprintf("%v %v", object.resource, object.Key())
+		}
+	}
+	for _, host := range sortedKeys(desired) {
+		err := c.syncHost(ctx, host, desired[host])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("syncing %v: %w", host, err))
+		}
+	}
+	for _, object := range objects {
+		if !object.HasFinalizer(kubeFinalizer) {
+			continue
+		}
+		current := make(map[string]bool)
+		if !object.IsDeleting() {
+			for _, host := range c.managedHosts(ctx, object) {
+				current[host] = true
+			}
+		}
+		var recorded []string
+		for _, host := range splitHosts(object.Metadata.Annotations[kubeHostsAnnotation]) {
+			if current[host] {
+				recorded = append(recorded, host)
+				continue
+			}
+			if kept[host] {
+				continue
+			}
+			err := c.removeHost(ctx, host)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("removing %v: %w", host, err))
+				recorded = append(recorded, host)
+			}
+		}
+		switch {
+		case object.IsDeleting() && len(recorded) == 0:
+			errs = append(errs, c.release(ctx, object))
+		case strings.Join(recorded, ",") != object.Metadata.Annotations[kubeHostsAnnotation]:
+			errs = append(errs, c.record(ctx, object, recorded))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// managedHosts returns the hosts of object in the managed domains. Other hosts are only warned about once.
+func (c *kubeController) managedHosts(ctx context.Context, object *kubeObject) []string {
+	var hosts []string
+	for _, host := range object.Hosts() {
+		if _, _, failure := splitManagedFQDN(host); failure != nil {
+			if !c.skipped[host] {
+				opnsense.Logger(ctx).Warnf("Skipping host of %v %v: %v", object.resource, object.Key(), failure.err)
+				c.skipped[host] = true
+			}
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// addresses returns the first IPv4 and IPv6 address of the load balancer of an Ingress, or of the Gateways of an
+// HTTPRoute. gateways caches the addresses of the Gateways by key.
+func (c *kubeController) addresses(ctx context.Context, object *kubeObject, gateways map[string][]string) ([]string, error) {
+	candidates := object.Addresses()
+	for _, ref := range object.Spec.ParentRefs {
+		if !ref.IsGateway() {
+			continue
+		}
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = object.Metadata.Namespace
+		}
+		key := namespace + "/" + ref.Name
+		gatewayAddresses, found := gateways[key]
+		if !found {
+			gateway, err := c.client.Get(ctx, kube.Gateways, namespace, ref.Name)
+			if err != nil && !kube.IsNotFound(err) {
+				return nil, fmt.Errorf("reading gateway %v: %w", key, err)
+			}
+			gatewayAddresses = gateway.Addresses()
+			gateways[key] = gatewayAddresses
+		}
+		candidates = append(candidates, gatewayAddresses...)
+	}
+	var addresses []string
+	recordTypes := make(map[string]bool)
+	for _, address := range candidates {
+		recordType, err := opnsense.RecordTypeForIP(address)
+		if err != nil || recordTypes[recordType] {
+			continue
+		}
+		recordTypes[recordType] = true
+		addresses = append(addresses, address)
+	}
+	normalized, failure := normalizeAddresses(addresses)
+	if failure != nil {
+		return nil, failure
+	}
+	return normalized, nil
+}
+
+// syncHost syncs the host overrides of host without aliases. The controller owns host and removes it with its object.
+// Hosts synced by someone else and hosts with records that were not created by OPNsenseProxyAPI are skipped.
+func (c *kubeController) syncHost(ctx context.Context, host string, addresses []string) error {
+	var failure *syncError
+	if stored, found := store.Get(host); !found || stored.Owner != kubeOwner {
+		failure = checkUnmanagedRecords(ctx, host)
+	}
+	if failure == nil {
+		request := syncAliasesRequest{Host: host, Addresses: addresses, Owner: kubeOwner}
+		response := newSyncAliasesResponse()
+		response.Host = host
+		failure = syncHost(ctx, request, addresses, response, false)
+		status := http.StatusOK
+		if failure != nil {
+			status = failure.status
+		}
+		syncsTotal.WithLabelValues(syncOutcome(status, false)).Inc()
+	}
+	if failure != nil && failure.status == http.StatusConflict {
+		if !c.conflicts[host] {
+			opnsense.Logger(ctx).Warnf("Skipping %v: %v", host, failure.err)
+			c.conflicts[host] = true
+		}
+		return nil
+	}
+	if failure != nil {
+		return failure
+	}
+	delete(c.conflicts, host)
+	opnsense.Logger(ctx).Debugf("Synced %v with [%v]", host, strings.Join(addresses, ", "))
+	return nil
+}
+
+// removeHost deletes the host overrides of host if the controller synced it. Hosts that are already gone are fine and
+// hosts synced by someone else are left alone.
+func (c *kubeController) removeHost(ctx context.Context, host string) error {
+	if stored, found := store.Get(host); !found || stored.Owner != kubeOwner {
+		opnsense.Logger(ctx).Infof("Not removing %v: it was not synced by the controller", host)
+		return nil
+	}
+	failure := removeHost(ctx, host, false, newDeleteHostResponse(host), false)
+	if failure != nil && failure.status != http.StatusNotFound {
+		return failure
+	}
+	opnsense.Logger(ctx).Infof("Removed %v", host)
+	return nil
+}
+
+// claim adds kubeFinalizer to object and hosts to its kubeHostsAnnotation, unless they are there already.
+func (c *kubeController) claim(ctx context.Context, object *kubeObject, hosts []string) error {
+	recorded := splitHosts(object.Metadata.Annotations[kubeHostsAnnotation])
+	claimed := append([]string{}, recorded...)
+	for _, host := range hosts {
+		if !containsString(claimed, host) {
+			claimed = append(claimed, host)
+		}
+	}
+	sort.Strings(claimed)
+	if object.HasFinalizer(kubeFinalizer) && len(claimed) == len(recorded) {
+		return nil
+	}
+	finalizers := object.Metadata.Finalizers
+	if !object.HasFinalizer(kubeFinalizer) {
+		finalizers = append(append([]string{}, finalizers...), kubeFinalizer)
+	}
+	return c.patch(ctx, object, finalizers, hostsAnnotation(claimed))
+}
+
+// record sets the kubeHostsAnnotation of object to hosts.
+func (c *kubeController) record(ctx context.Context, object *kubeObject, hosts []string) error {
+	return c.patch(ctx, object, object.Metadata.Finalizers, hostsAnnotation(hosts))
+}
+
+// release removes kubeFinalizer and kubeHostsAnnotation from object, so that its deletion completes.
+func (c *kubeController) release(ctx context.Context, object *kubeObject) error {
+	var finalizers []string
+	for _, finalizer := range object.Metadata.Finalizers {
+		if finalizer != kubeFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	err := c.patch(ctx, object, finalizers, map[string]*string{kubeHostsAnnotation: nil})
+	if err == nil {
+		opnsense.Logger(ctx).Infof("Released %v %v", object.resource, object.Key())
+	}
+	return err
+}
+
+// patch changes the metadata of object and updates object with the result. Conflicts are retried by the next sync.
+func (c *kubeController) patch(ctx context.Context, object *kubeObject, finalizers []string, annotations map[string]*string) error {
+	patched, err := c.client.PatchMetadata(ctx, object.resource, object.Object, finalizers, annotations)
+	if err != nil {
+		return fmt.Errorf("updating %v %v: %w", object.resource, object.Key(), err)
+	}
+	object.Object = patched
+	return nil
+}
+
+// hostsAnnotation returns the kubeHostsAnnotation for hosts, which is removed when there are none.
+func hostsAnnotation(hosts []string) map[string]*string {
+	if len(hosts) == 0 {
+		return map[string]*string{kubeHostsAnnotation: nil}
+	}
+	value := strings.Join(hosts, ",")
+	return map[string]*string{kubeHostsAnnotation: &value}
+}
+
+// splitHosts splits a kubeHostsAnnotation.
+func splitHosts(annotation string) []string {
+	var hosts []string
+	for _, host := range strings.Split(annotation, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
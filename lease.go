@@ -0,0 +1,123 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// leaseExpirer deletes hosts whose last sync is older than the lease duration, so that proxies that
+// disappear without deregistering don't stay in Unbound forever. Every sync renews the lease of its host.
+type leaseExpirer struct {
+	store    *stateStore
+	duration time.Duration
+	// timeout applies to the deletion of every host and to every reconfiguration, so many expired hosts don't run out of time
+	timeout time.Duration
+}
+
+func newLeaseExpirer(store *stateStore, duration time.Duration) *leaseExpirer {
+	return &leaseExpirer{store: store, duration: duration, timeout: 60 * time.Second}
+}
+
+// checkInterval is a tenth of the lease duration, between one second and one minute.
+func (expirer *leaseExpirer) checkInterval() time.Duration {
+	interval := expirer.duration / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+func (expirer *leaseExpirer) expiresAt(host desiredHost) time.Time {
+	return host.UpdatedAt.Add(expirer.duration)
+}
+
+// Run deletes expired hosts until ctx is done.
+func (expirer *leaseExpirer) Run(ctx context.Context) {
+	log.Infof("Expiring hosts that are not synced within %v", expirer.duration)
+	ticker := time.NewTicker(expirer.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expirer.expire(ctx, now)
+		}
+	}
+}
+
+// expire deletes the aliases and host overrides of every host whose lease ended before now, followed by
+// a single reconfiguration of Unbound on every target something was deleted from. It returns the expired hosts.
+func (expirer *leaseExpirer) expire(ctx context.Context, now time.Time) []string {
+	var expired []string
+	deleted := make([]bool, len(targets))
+	for _, host := range expirer.store.Hosts() {
+		if host.Owner != "" || now.Before(expirer.expiresAt(host)) {
+			continue
+		}
+		if expirer.expireHost(ctx, host.Host, now, deleted) {
+			expired = append(expired, host.Host)
+		}
+	}
+	forEachTarget(func(i int, t *target) *syncError {
+		if !deleted[i] {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, expirer.timeout)
+		defer cancel()
+		err := t.client.ReconfigureContext(ctx)
+		if err != nil {
+			log.Errorf("Error while reconfiguring Unbound on %v: %v", t.name, err)
+		}
+		return nil
+	})
+	return expired
+}
+
+// expireHost deletes fqdn from every target unless a sync renewed its lease in the meantime. It reports whether
+// the lease ended and marks the targets something was deleted from in deleted.
+func (expirer *leaseExpirer) expireHost(ctx context.Context, fqdn string, now time.Time, deleted []bool) bool {
+	ctx, cancel := context.WithTimeout(ctx, expirer.timeout)
+	defer cancel()
+	unlock, err := hostLocks.lock(ctx, fqdn)
+	if err != nil {
+		log.Errorf("Error while waiting for a sync of %v: %v", fqdn, err)
+		return false
+	}
+	defer unlock()
+	host, ok := expirer.store.Get(fqdn)
+	if !ok || host.Owner != "" || now.Before(expirer.expiresAt(host)) {
+		return false
+	}
+	log.Infof("Lease of %v expired at %v", fqdn, expirer.expiresAt(host))
+	failures := forEachTarget(func(i int, t *target) *syncError {
+		ctx := targetContext(ctx, t)
+		result := newTargetDeleteResult(t.name)
+		failure := deleteHost(ctx, t.client, fqdn, false, result)
+		if result.deletedAnything() {
+			deleted[i] = true
+		}
+		if failure != nil && (failure.status == http.StatusNotFound || failure.status == http.StatusConflict) {
+			opnsense.Logger(ctx).Warnf("Not deleting expired host %v: %v", fqdn, failure)
+			return nil
+		}
+		return failure
+	})
+	failure := combineFailures(failures)
+	if failure != nil {
+		// keep the lease, so the deletion is retried
+		log.Errorf("Error while deleting expired host %v: %v", fqdn, failure)
+		return false
+	}
+	err = expirer.store.Delete(fqdn)
+	if err != nil {
+		log.Errorf("Error while removing lease of %v: %v", fqdn, err)
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+var hostLocks = newHostLocker()
+
+// hostLocker serializes every change to one host. Without it, concurrent syncs of the same FQDN both see a missing
+// host override and create it twice, or delete the aliases the other sync just created.
+type hostLocker struct {
+	mu    sync.Mutex
+	locks map[string]*hostLock
+}
+
+// hostLock is held by whoever sent to its channel. refs counts holders and waiters, so unused locks can be dropped.
+type hostLock struct {
+	held chan struct{}
+	refs int
+}
+
+func newHostLocker() *hostLocker {
+	return &hostLocker{locks: make(map[string]*hostLock)}
+}
+
+// lock waits until no one else holds the lock of fqdn, or ctx is done.
+// The returned function releases the lock and may be called more than once.
+func (locker *hostLocker) lock(ctx context.Context, fqdn string) (func(), error) {
+	key := strings.ToLower(fqdn)
+	locker.mu.Lock()
+	lock, ok := locker.locks[key]
+	if !ok {
+		lock = &hostLock{held: make(chan struct{}, 1)}
+		locker.locks[key] = lock
+	}
+	lock.refs++
+	locker.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				<-lock.held
+				locker.release(key, lock)
+			})
+		}, nil
+	case <-ctx.Done():
+		locker.release(key, lock)
+		return nil, ctx.Err()
+	}
+}
+
+func (locker *hostLocker) release(key string, lock *hostLock) {
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(locker.locks, key)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// configureLogging sets the format, "text" (the default) or "json", and the level, e.g. "debug", of the standard logger.
+func configureLogging(format, level string) error {
+	switch format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, must be text or json", format)
+	}
+	if level == "" {
+		return nil
+	}
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(parsed)
+	return nil
+}
+
+// accessLog attaches a logger with the request ID and the caller's IP to the request context, so that every
+// line logged for the request can be attributed, and logs each request with its status and duration.
+// Health checks and metrics scrapes are only logged at debug level.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ip, err := getIPAddress(r)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		logger := log.WithFields(log.Fields{"request_id": middleware.GetReqID(r.Context()), "ip": ip})
+		recorder := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(recorder, r.WithContext(opnsense.WithLogger(r.Context(), logger)))
+		status := recorder.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry := logger.WithFields(log.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       recorder.BytesWritten(),
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		})
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			entry.Debug("Handled request")
+		default:
+			entry.Info("Handled request")
+		}
+	})
+}
+
+// withHostLogger returns a copy of r whose logger adds the FQDN of the host the request changes, and that logger.
+func withHostLogger(r *http.Request, fqdn string) (*http.Request, *log.Entry) {
+	logger := opnsense.Logger(r.Context()).WithField("host", fqdn)
+	return r.WithContext(opnsense.WithLogger(r.Context(), logger)), logger
+}
+
+// targetContext returns a copy of ctx whose logger adds the name of t.
+func targetContext(ctx context.Context, t *target) context.Context {
+	return opnsense.WithLogger(ctx, opnsense.Logger(ctx).WithField("target", t.name))
+}
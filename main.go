@@ -2,104 +2,379 @@ package main
 
 import (
 	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
 
-type syncAliasesRequest struct {
-	Host    string   `json:"host"`
-	Aliases []string `json:"aliases"`
+var domains []string
+var apiTokens []apiToken
+var trustedProxies []*net.IPNet
+var store *stateStore
+var hostReconciler *reconciler
+var hostLeases *leaseExpirer
+
+// apiToken is a bearer token that may only sync hosts and aliases matching one of its allowed FQDN patterns.
+type apiToken struct {
+	token        string
+	allowedHosts []string
 }
 
-var apiKey string
-var apiSecret string
-var address string
-var domainName string
+type apiTokenContextKey struct{}
+
+// Run modes, given as the first argument. Every mode serves the API.
+const (
+	modeServe        = "serve"
+	modeWatchDocker  = "watch-docker"
+	modeWatchTraefik = "watch-traefik"
+	modeWatchCaddy   = "watch-caddy"
+	modeWatchKube    = "watch-kubernetes"
+)
 
 func main() {
-	apiKey = os.Getenv("API_KEY")
-	apiSecret = os.Getenv("API_SECRET")
-	address = os.Getenv("OPNSENSE_ADDRESS")
-	domainName = os.Getenv("DOMAIN_NAME")
-	if apiKey == "" {
-		log.Fatalf("API_KEY not set")
+	mode := modeServe
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
 	}
-	if apiSecret == "" {
-		log.Fatalf("API_SECRET not set")
+	switch mode {
+	case modeServe, modeWatchDocker, modeWatchTraefik, modeWatchCaddy, modeWatchKube:
+	default:
+		log.Fatalf("Unknown mode %q, must be one of %v, %v, %v, %v, %v", mode, modeServe, modeWatchDocker, modeWatchTraefik, modeWatchCaddy, modeWatchKube)
 	}
-	if address == "" {
-		log.Fatalf("OPNSENSE_ADDRESS not set")
+	cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatalf("Error while loading configuration: %v", err)
 	}
-	if domainName == "" {
+	err = configureLogging(cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("Error while configuring logging: %v", err)
+	}
+	domains = cfg.Domains
+	syncMode = cfg.SyncMode
+	targetConfigs, err := cfg.targetConfigs()
+	if err != nil {
+		log.Fatalf("Error while configuring OPNsense targets: %v", err)
+	}
+	if len(domains) == 0 {
 		log.Fatalf("DOMAIN_NAME not set")
 	}
+	apiTokens, err = newAPITokens(cfg.APITokens, domains)
+	if err != nil {
+		log.Fatalf("Error while parsing API tokens: %v", err)
+	}
+	if len(apiTokens) == 0 {
+		log.Warnf("API_TOKENS not set. Requests will not be authenticated")
+	}
+	trustedProxies, err = parseTrustedProxies(strings.Join(cfg.TrustedProxies, ","))
+	if err != nil {
+		log.Fatalf("Error while parsing TRUSTED_PROXIES: %v", err)
+	}
+	quietPeriod, err := parseDuration(cfg.ReconfigureQuietPeriod, 2*time.Second)
+	if err != nil {
+		log.Fatalf("Error while parsing RECONFIGURE_QUIET_PERIOD: %v", err)
+	}
+	maxDelay, err := parseDuration(cfg.ReconfigureMaxDelay, 10*time.Second)
+	if err != nil {
+		log.Fatalf("Error while parsing RECONFIGURE_MAX_DELAY: %v", err)
+	}
+	for _, targetConfig := range targetConfigs {
+		t, err := newTarget(targetConfig, quietPeriod, maxDelay)
+		if err != nil {
+			log.Fatalf("Error while configuring TLS of target %v: %v", targetConfig.Name, err)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) > 1 {
+		log.Infof("Managing %v OPNsense targets in %v mode", len(targets), syncMode)
+	}
+	store, err = loadStateStore(cfg.StateFile)
+	if err != nil {
+		log.Fatalf("Error while loading STATE_FILE: %v", err)
+	}
+	reconcileInterval, err := parseDuration(cfg.ReconcileInterval, 0)
+	if err != nil {
+		log.Fatalf("Error while parsing RECONCILE_INTERVAL: %v", err)
+	}
+	if reconcileInterval > 0 {
+		hostReconciler = newReconciler(store, reconcileInterval)
+		go hostReconciler.Run(context.Background())
+	}
+	leaseDuration, err := parseDuration(cfg.LeaseDuration, 0)
+	if err != nil {
+		log.Fatalf("Error while parsing LEASE_DURATION: %v", err)
+	}
+	if leaseDuration > 0 {
+		hostLeases = newLeaseExpirer(store, leaseDuration)
+		go hostLeases.Run(context.Background())
+	}
+	switch mode {
+	case modeWatchDocker:
+		watcher, err := newDockerWatcher(cfg.Watch)
+		if err != nil {
+			log.Fatalf("Error while configuring the Docker watcher: %v", err)
+		}
+		go watcher.Run(context.Background())
+	case modeWatchTraefik:
+		watcher, err := newTraefikWatcher(cfg.Watch)
+		if err != nil {
+			log.Fatalf("Error while configuring the Traefik watcher: %v", err)
+		}
+		go watcher.Run(context.Background())
+	case modeWatchCaddy:
+		watcher, err := newCaddyWatcher(cfg.Watch)
+		if err != nil {
+			log.Fatalf("Error while configuring the Caddy watcher: %v", err)
+		}
+		go watcher.Run(context.Background())
+	case modeWatchKube:
+		controller, err := newKubeController(cfg.Watch)
+		if err != nil {
+			log.Fatalf("Error while configuring the Kubernetes controller: %v", err)
+		}
+		go controller.Run(context.Background())
+	}
+
+	if cfg.WebhookAddress != "" {
+		log.Infof("Running ExternalDNS webhook on %v", cfg.WebhookAddress)
+		go func() {
+			err := http.ListenAndServe(cfg.WebhookAddress, newWebhookRouter())
+			log.Fatalf("Error while serving the ExternalDNS webhook: %v", err)
+		}()
+	}
 
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	// r.Use(middleware.Logger)
+	r.Use(realIPFromTrustedProxies)
+	r.Use(accessLog)
 	r.Use(middleware.Recoverer)
 
 	r.Use(middleware.Timeout(60 * time.Second))
-	r.Post("/sync", handleSyncAliasesRequest)
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/healthz", handleHealthzRequest)
+	r.Get("/readyz", handleReadyzRequest)
+	r.Group(func(r chi.Router) {
+		r.Use(requireAPIToken)
+		r.Post("/sync", handleSyncAliasesRequest)
+		r.Get("/hosts", handleGetHostsRequest)
+		r.Get("/hosts/{fqdn}", handleGetHostRequest)
+		r.Get("/hosts/{fqdn}/aliases", handleGetHostAliasesRequest)
+		r.Delete("/hosts/{fqdn}", handleDeleteHostRequest)
+		r.Get("/reconcile", handleGetReconcileRequest)
+	})
 	log.Infof("Running API on port 9657")
 	http.ListenAndServe(":9657", r)
 }
 
-func handleSyncAliasesRequest(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	var request syncAliasesRequest
-	err := decoder.Decode(&request)
+func parseBoolQuery(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
 	if err != nil {
-		log.Errorf("Error while decoding sync request: %v", err)
+		return false, fmt.Errorf("invalid value %q for %v", value, name)
 	}
-	opnsenseClient := opnsense.NewClient(address, apiKey, apiSecret)
-	// check if host exists
-	exists, err := opnsenseClient.DoesHostOverrideExist(request.Host)
+	return parsed, nil
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
 	if err != nil {
-		log.Errorf("Error while checking if host override exists: %v", err)
+		log.Errorf("Error while encoding response: %v", err)
 	}
-	if !exists {
-		hostIP, err := getIPAddress(r)
-		if err != nil {
-			log.Errorf("Error while extracting host IP: %v", err)
+}
+
+func getIPAddress(r *http.Request) (string, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// middleware.RealIP replaces RemoteAddr with the bare client IP
+		if net.ParseIP(r.RemoteAddr) != nil {
+			return r.RemoteAddr, nil
 		}
-		hostname := strings.Replace(request.Host, fmt.Sprintf(".%v", domainName), "", -1)
-		log.Infof("%v does not exist. Creating host override with hostname (%v), domain (%v) and IP (%v)", request.Host, hostname, domainName, hostIP)
-		hostOverride := opnsense.NewHostOverride(hostname, domainName, hostIP)
-		_, err = opnsenseClient.CreateHostOverride(hostOverride)
-		if err != nil {
-			log.Errorf("Error while creating host override: %v", err)
+		return "", err
+	}
+	return ip, nil
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES, a comma separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a valid IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-		err = opnsenseClient.Reconfigure()
+		_, network, err := net.ParseCIDR(entry)
 		if err != nil {
-			log.Errorf("Error while reconfiguring Unbound: %v", err)
+			return nil, err
 		}
+		networks = append(networks, network)
 	}
-	// sync aliases
-	_, err = opnsenseClient.SyncAliases(request.Host, request.Aliases, domainName)
+	return networks, nil
+}
+
+// realIPFromTrustedProxies honors the headers used by middleware.RealIP only for requests coming from a trusted proxy,
+// so that other callers cannot choose the address of their host override.
+func realIPFromTrustedProxies(next http.Handler) http.Handler {
+	realIP := middleware.RealIP(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTrustedProxy(r.RemoteAddr) {
+			realIP.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		log.Errorf("Error while syncing alias overrides: %v", err)
+		host = remoteAddr
 	}
-	err = opnsenseClient.Reconfigure()
-	if err != nil {
-		log.Errorf("Error while reconfiguring Unbound: %v", err)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
 	}
+	return false
 }
 
-func getIPAddress(r *http.Request) (string, error) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return "", err
+// parseAPITokens parses API_TOKENS in the form "token1=pattern,pattern;token2=pattern".
+func parseAPITokens(value string) ([]apiTokenConfig, error) {
+	var tokens []apiTokenConfig
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		token, patterns, found := strings.Cut(entry, "=")
+		token = strings.TrimSpace(token)
+		if !found || token == "" || strings.TrimSpace(patterns) == "" {
+			return nil, fmt.Errorf("token entry %q must be in the form token=pattern[,pattern]", entry)
+		}
+		tokens = append(tokens, apiTokenConfig{Token: token, Hosts: strings.Split(patterns, ",")})
 	}
-	return ip, nil
+	return tokens, nil
+}
+
+// newAPITokens validates the configured tokens. Patterns are FQDN globs (e.g. "proxy1" or "*.proxy1.example.com").
+// Patterns that don't end with one of domains are relative to the first domain.
+func newAPITokens(configs []apiTokenConfig, domains []string) ([]apiToken, error) {
+	var tokens []apiToken
+	for _, tokenConfig := range configs {
+		if tokenConfig.Token == "" {
+			return nil, errors.New("token must not be empty")
+		}
+		var allowedHosts []string
+		for _, pattern := range tokenConfig.Hosts {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if pattern == "" {
+				continue
+			}
+			if _, _, ok := opnsense.SplitFQDN(pattern, domains); !ok && len(domains) > 0 {
+				pattern = fmt.Sprintf("%v.%v", pattern, domains[0])
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			allowedHosts = append(allowedHosts, pattern)
+		}
+		if len(allowedHosts) == 0 {
+			return nil, errors.New("every token needs at least one host pattern")
+		}
+		tokens = append(tokens, apiToken{token: tokenConfig.Token, allowedHosts: allowedHosts})
+	}
+	return tokens, nil
+}
+
+// requireAPIToken rejects requests without a valid bearer token and stores the matched token in the request context.
+// Every request is allowed when no tokens are configured.
+func requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(apiTokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := findAPIToken(r.Header.Get("Authorization"))
+		if err != nil {
+			log.Warnf("Rejecting request from %v: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="OPNsenseProxyAPI"`)
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenContextKey{}, token)))
+	})
+}
+
+func findAPIToken(authorization string) (*apiToken, error) {
+	scheme, value, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || value == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	for i := range apiTokens {
+		if subtle.ConstantTimeCompare([]byte(apiTokens[i].token), []byte(value)) == 1 {
+			return &apiTokens[i], nil
+		}
+	}
+	return nil, errors.New("unknown bearer token")
+}
+
+// isAuthorizedFor reports whether the token attached to ctx may manage every given FQDN.
+func isAuthorizedFor(ctx context.Context, fqdns ...string) bool {
+	token, ok := ctx.Value(apiTokenContextKey{}).(*apiToken)
+	if !ok {
+		return len(apiTokens) == 0
+	}
+	for _, fqdn := range fqdns {
+		if !token.allows(fqdn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *apiToken) allows(fqdn string) bool {
+	for _, pattern := range t.allowedHosts {
+		if matched, _ := path.Match(pattern, fqdn); matched {
+			return true
+		}
+	}
+	return false
 }
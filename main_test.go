@@ -0,0 +1,1731 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/caddy/caddytest"
+	"OPNsenseProxyAPI/docker/dockertest"
+	"OPNsenseProxyAPI/kube/kubetest"
+	"OPNsenseProxyAPI/opnsense"
+	"OPNsenseProxyAPI/opnsense/opnsensetest"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestOPNsense points targets to a single fake OPNsense named "default" for the duration of the test.
+func useTestOPNsense(t *testing.T) *opnsensetest.Server {
+	return useTestTargets(t, "default")[0]
+}
+
+// useTestTargets points targets to a fake OPNsense per name for the duration of the test.
+func useTestTargets(t *testing.T, names ...string) []*opnsensetest.Server {
+	var servers []*opnsensetest.Server
+	for _, name := range names {
+		server := opnsensetest.NewServer()
+		t.Cleanup(server.Close)
+		target, err := newTarget(opnsenseConfig{
+			Name:       name,
+			Address:    server.URL,
+			APIKey:     server.APIKey,
+			APISecret:  server.APISecret,
+			CertSHA256: server.CertificateSHA256(),
+		}, 0, 0)
+		if err != nil {
+			t.Fatalf("newTarget() error = %v", err)
+		}
+		targets = append(targets, target)
+		servers = append(servers, server)
+	}
+	domains = []string{"example.com"}
+	store, _ = loadStateStore("")
+	t.Cleanup(func() {
+		targets = nil
+		syncMode = syncModeAll
+		domains = nil
+		store = nil
+	})
+	return servers
+}
+
+func newTestRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/healthz", handleHealthzRequest)
+	r.Get("/readyz", handleReadyzRequest)
+	r.Group(func(r chi.Router) {
+		r.Use(requireAPIToken)
+		r.Post("/sync", handleSyncAliasesRequest)
+		r.Get("/hosts", handleGetHostsRequest)
+		r.Get("/hosts/{fqdn}", handleGetHostRequest)
+		r.Get("/hosts/{fqdn}/aliases", handleGetHostAliasesRequest)
+		r.Delete("/hosts/{fqdn}", handleDeleteHostRequest)
+		r.Get("/reconcile", handleGetReconcileRequest)
+	})
+	return r
+}
+
+func serveTestRequest(t *testing.T, method, target, body string, response any) int {
+	return serveTestRequestWithToken(t, method, target, "", body, response)
+}
+
+// serveTestRequestWithToken serves a request with the bearer token, if it is not empty.
+func serveTestRequestWithToken(t *testing.T, method, target, token, body string, response any) int {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.RemoteAddr = "10.0.0.5:51234"
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	newTestRouter().ServeHTTP(recorder, request)
+	if response != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatalf("decoding response %q: %v", recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func Test_parseAPITokens(t *testing.T) {
+	type args struct {
+		value   string
+		domains []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []apiToken
+		wantErr bool
+	}{
+		{
+			name: "Parse relative and absolute patterns",
+			args: args{value: "secret1=proxy1,*.proxy1; secret2=proxy2.example.com", domains: []string{"example.com"}},
+			want: []apiToken{
+				{token: "secret1", allowedHosts: []string{"proxy1.example.com", "*.proxy1.example.com"}},
+				{token: "secret2", allowedHosts: []string{"proxy2.example.com"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Parse patterns of several domains",
+			args: args{value: "secret1=proxy1,proxy1.example.org", domains: []string{"example.com", "example.org"}},
+			want: []apiToken{
+				{token: "secret1", allowedHosts: []string{"proxy1.example.com", "proxy1.example.org"}},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "Parse empty value",
+			args:    args{value: "", domains: []string{"example.com"}},
+			want:    nil,
+			wantErr: false,
+		},
+		{
+			name:    "Parse entry without patterns",
+			args:    args{value: "secret1", domains: []string{"example.com"}},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "Parse invalid pattern",
+			args:    args{value: "secret1=[proxy", domains: []string{"example.com"}},
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs, err := parseAPITokens(tt.args.value)
+			var got []apiToken
+			if err == nil {
+				got, err = newAPITokens(configs, tt.args.domains)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAPITokens() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAPITokens() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+opnsense:
+  address: https://opnsense.example.com
+  apiKey: key
+  apiSecret: secret
+domains:
+  - example.com
+  - Lab.Example.com.
+apiTokens:
+  - token: secret1
+    hosts: ["proxy1", "*.proxy1.lab.example.com"]
+reconcileInterval: 5m
+`), 0o600)
+	if err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+	t.Setenv("API_SECRET", "other")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1,10.0.0.2")
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	want := config{
+		OPNsense:          opnsenseConfig{Address: "https://opnsense.example.com", APIKey: "key", APISecret: "other"},
+		Domains:           []string{"example.com", "lab.example.com"},
+		APITokens:         []apiTokenConfig{{Token: "secret1", Hosts: []string{"proxy1", "*.proxy1.lab.example.com"}}},
+		TrustedProxies:    []string{"10.0.0.1", "10.0.0.2"},
+		ReconcileInterval: "5m",
+		SyncMode:          syncModeAll,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loadConfig() got = %+v, want %+v", cfg, want)
+	}
+
+	err = os.WriteFile(path, []byte("domain: example.com\n"), 0o600)
+	if err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Errorf("loadConfig() with unknown setting error = nil, want error")
+	}
+}
+
+func Test_loadConfig_lease(t *testing.T) {
+	tests := []struct {
+		name          string
+		leaseDuration string
+		stateFile     string
+		wantErr       bool
+	}{
+		{name: "Lease with state file", leaseDuration: "1h", stateFile: "/var/lib/opnsense-proxy-api/state.json"},
+		{name: "Lease without state file", leaseDuration: "1h", wantErr: true},
+		{name: "Disabled lease without state file", leaseDuration: "0"},
+		{name: "Invalid lease", leaseDuration: "one hour", stateFile: "/var/lib/opnsense-proxy-api/state.json", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LEASE_DURATION", tt.leaseDuration)
+			t.Setenv("STATE_FILE", tt.stateFile)
+			_, err := loadConfig("")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_loadConfig_webhook(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		allowRemote string
+		wantErr     bool
+	}{
+		{name: "Localhost", address: "localhost:8888"},
+		{name: "IPv4 loopback", address: "127.0.0.1:8888"},
+		{name: "IPv6 loopback", address: "[::1]:8888"},
+		{name: "Every interface", address: ":8888", wantErr: true},
+		{name: "Other address", address: "10.0.0.2:8888", wantErr: true},
+		{name: "Other address allowed", address: "10.0.0.2:8888", allowRemote: "true"},
+		{name: "Invalid opt-in", address: "10.0.0.2:8888", allowRemote: "yes please", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_ADDRESS", tt.address)
+			t.Setenv("WEBHOOK_ALLOW_REMOTE", tt.allowRemote)
+			_, err := loadConfig("")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_config_targetConfigs(t *testing.T) {
+	primary := opnsenseConfig{Address: "https://10.0.0.2", APIKey: "key", APISecret: "secret"}
+	secondary := opnsenseConfig{Name: "secondary", Address: "https://10.0.0.3", APIKey: "key", APISecret: "secret"}
+	tests := []struct {
+		name    string
+		cfg     config
+		want    []string
+		wantErr bool
+	}{
+		{name: "OPNsense section", cfg: config{OPNsense: primary}, want: []string{"default"}},
+		{name: "OPNsense section and targets", cfg: config{OPNsense: primary, Targets: []opnsenseConfig{secondary}}, want: []string{"default", "secondary"}},
+		{name: "Only targets", cfg: config{Targets: []opnsenseConfig{secondary}}, want: []string{"secondary"}},
+		{name: "No target", cfg: config{}, wantErr: true},
+		{name: "Target without name", cfg: config{Targets: []opnsenseConfig{primary}}, wantErr: true},
+		{name: "Duplicate name", cfg: config{Targets: []opnsenseConfig{secondary, secondary}}, wantErr: true},
+		{name: "Missing credentials", cfg: config{OPNsense: opnsenseConfig{Address: "https://10.0.0.2"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetConfigs, err := tt.cfg.targetConfigs()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("targetConfigs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, targetConfig := range targetConfigs {
+				got = append(got, targetConfig.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("targetConfigs() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_requireAPIToken(t *testing.T) {
+	apiTokens = []apiToken{
+		{token: "secret1", allowedHosts: []string{"proxy1.example.com", "*.proxy1.example.com"}},
+	}
+	defer func() { apiTokens = nil }()
+	tests := []struct {
+		name          string
+		authorization string
+		fqdns         []string
+		wantStatus    int
+		wantAllowed   bool
+	}{
+		{
+			name:          "Missing token",
+			authorization: "",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "Unknown token",
+			authorization: "Bearer secret2",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "Token allowed for host and aliases",
+			authorization: "Bearer secret1",
+			fqdns:         []string{"proxy1.example.com", "app.proxy1.example.com"},
+			wantStatus:    http.StatusOK,
+			wantAllowed:   true,
+		},
+		{
+			name:          "Token not allowed for other host",
+			authorization: "Bearer secret1",
+			fqdns:         []string{"proxy1.example.com", "proxy2.example.com"},
+			wantStatus:    http.StatusOK,
+			wantAllowed:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAllowed bool
+			handler := requireAPIToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAllowed = isAuthorizedFor(r.Context(), tt.fqdns...)
+			}))
+			request := httptest.NewRequest(http.MethodPost, "/sync", nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("requireAPIToken() status = %v, want %v", recorder.Code, tt.wantStatus)
+			}
+			if gotAllowed != tt.wantAllowed {
+				t.Errorf("isAuthorizedFor() got = %v, want %v", gotAllowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func Test_isAuthorizedFor_withoutTokens(t *testing.T) {
+	if !isAuthorizedFor(context.Background(), "anything.example.com") {
+		t.Errorf("isAuthorizedFor() got = false, want true when no tokens are configured")
+	}
+}
+
+func Test_getSyncAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		ip         string
+		addresses  []string
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name:       "Use caller address",
+			remoteAddr: "[fd00::5]:51234",
+			want:       []string{"fd00::5"},
+		},
+		{
+			name:       "Use dual-stack addresses",
+			remoteAddr: "10.0.0.1:51234",
+			addresses:  []string{"10.0.0.5", "FD00:0::5"},
+			want:       []string{"10.0.0.5", "fd00::5"},
+		},
+		{
+			name:       "Use explicit IP",
+			remoteAddr: "172.17.0.1:51234",
+			ip:         "10.0.0.5",
+			want:       []string{"10.0.0.5"},
+		},
+		{
+			name:       "Use caller address set by middleware.RealIP",
+			remoteAddr: "10.0.0.5",
+			want:       []string{"10.0.0.5"},
+		},
+		{
+			name:       "Reject explicit IP combined with addresses",
+			remoteAddr: "10.0.0.1:51234",
+			ip:         "10.0.0.5",
+			addresses:  []string{"fd00::5"},
+			wantErr:    true,
+		},
+		{
+			name:       "Reject invalid explicit IP",
+			remoteAddr: "10.0.0.1:51234",
+			ip:         "proxy1",
+			wantErr:    true,
+		},
+		{
+			name:       "Reject invalid address",
+			remoteAddr: "10.0.0.1:51234",
+			addresses:  []string{"10.0.0"},
+			wantErr:    true,
+		},
+		{
+			name:       "Reject two addresses of one family",
+			remoteAddr: "10.0.0.1:51234",
+			addresses:  []string{"10.0.0.5", "10.0.0.6"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/sync", nil)
+			request.RemoteAddr = tt.remoteAddr
+			got, failure := getSyncAddresses(request, syncAliasesRequest{Host: "host.example.com", IP: tt.ip, Addresses: tt.addresses})
+			if (failure != nil) != tt.wantErr {
+				t.Errorf("getSyncAddresses() error = %v, wantErr %v", failure, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSyncAddresses() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_realIPFromTrustedProxies(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("172.17.0.0/16, 10.0.0.1")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies() error = %v", err)
+	}
+	defer func() { trustedProxies = nil }()
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "Honor header from trusted network",
+			remoteAddr: "172.17.0.2:51234",
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "Honor header from trusted address",
+			remoteAddr: "10.0.0.1:51234",
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "Ignore header from untrusted address",
+			remoteAddr: "10.0.0.2:51234",
+			want:       "10.0.0.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := realIPFromTrustedProxies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = getIPAddress(r)
+			}))
+			request := httptest.NewRequest(http.MethodPost, "/sync", nil)
+			request.RemoteAddr = tt.remoteAddr
+			request.Header.Set("X-Forwarded-For", "10.0.0.5")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			if got != tt.want {
+				t.Errorf("getIPAddress() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handleSyncAliasesRequest(t *testing.T) {
+	server := useTestOPNsense(t)
+	body := `{"host": "proxy1.example.com", "aliases": ["app1.example.com", "app2.example.com"]}`
+
+	var dryRun syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync?dryRun=true", body, &dryRun)
+	if status != http.StatusOK || dryRun.Targets[0].Plan == nil || dryRun.Targets[0].Plan.HostOverrides[0].Action != hostOverrideActionCreate || len(dryRun.Targets[0].Plan.Aliases.Create) != 2 {
+		t.Fatalf("dry run got status %v and %+v", status, dryRun)
+	}
+	if len(server.HostOverrides()) != 0 {
+		t.Fatalf("dry run created host overrides")
+	}
+
+	var created syncAliasesResponse
+	status = serveTestRequest(t, http.MethodPost, "/sync", body, &created)
+	if status != http.StatusOK || created.Targets[0].HostOverrides[0].Action != hostOverrideCreated || len(created.Targets[0].AliasesCreated) != 2 || !created.Targets[0].Reconfigured {
+		t.Fatalf("sync got status %v and %+v", status, created)
+	}
+
+	var updated syncAliasesResponse
+	status = serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "ip": "10.0.0.6", "aliases": ["app1.example.com"]}`, &updated)
+	if status != http.StatusOK || updated.Targets[0].HostOverrides[0].Action != hostOverrideUpdated || !reflect.DeepEqual(updated.Targets[0].AliasesDeleted, []string{"app2.example.com"}) {
+		t.Fatalf("sync with new IP got status %v and %+v", status, updated)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].Server != "10.0.0.6" {
+		t.Errorf("sync with new IP left host overrides %v", hosts)
+	}
+
+	server.InjectFault("addHostAlias", opnsensetest.Fault{Status: http.StatusInternalServerError})
+	var failed syncAliasesResponse
+	status = serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com", "app3.example.com"]}`, &failed)
+	if status != http.StatusBadGateway || len(failed.Errors) != 1 || failed.Errors[0].Step != "syncAliases" {
+		t.Errorf("sync with failing OPNsense got status %v and %+v", status, failed)
+	}
+
+	status = serveTestRequest(t, http.MethodPost, "/sync", `{"host": `, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("sync with malformed body got status %v, want %v", status, http.StatusBadRequest)
+	}
+}
+
+func Test_handleSyncAliasesRequest_errors(t *testing.T) {
+	tests := []struct {
+		name              string
+		body              string
+		fault             string
+		wantStatus        int
+		wantStep          string
+		wantHostOverrides int
+	}{
+		{name: "Reject malformed request", body: `{"host": `, wantStatus: http.StatusBadRequest, wantStep: "decode"},
+		{name: "Reject request without host", body: `{"aliases": ["app1.example.com"]}`, wantStatus: http.StatusBadRequest, wantStep: "validate"},
+		{name: "Fail when OPNsense fails", body: `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`, fault: "searchHostOverride", wantStatus: http.StatusBadGateway, wantStep: "checkHostOverride"},
+		{name: "Stop after failing to create the host override", body: `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`, fault: "addHostOverride", wantStatus: http.StatusBadGateway, wantStep: "createHostOverride"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := useTestOPNsense(t)
+			if tt.fault != "" {
+				server.InjectFault(tt.fault, opnsensetest.Fault{Status: http.StatusInternalServerError})
+			}
+			var response syncAliasesResponse
+			status := serveTestRequest(t, http.MethodPost, "/sync", tt.body, &response)
+			if status != tt.wantStatus || len(response.Errors) != 1 || response.Errors[0].Step != tt.wantStep {
+				t.Errorf("sync got status %v and errors %+v, want %v with step %v", status, response.Errors, tt.wantStatus, tt.wantStep)
+			}
+			if hosts := server.HostOverrides(); len(hosts) != tt.wantHostOverrides {
+				t.Errorf("sync left host overrides %v, want %v", hosts, tt.wantHostOverrides)
+			}
+			// processing stops at the failing step
+			if calls := server.Calls("addHostAlias") + server.Reconfigures(); calls != 0 {
+				t.Errorf("sync made %v calls after failing, want none", calls)
+			}
+		})
+	}
+}
+
+func Test_handleSyncAliasesRequest_sharedAlias(t *testing.T) {
+	server := useTestOPNsense(t)
+	proxy1 := server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "example.com", Type: "A", Server: "192.0.2.1", Description: opnsense.ManagedDescriptionMarker})
+	proxy2 := server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy2", Domain: "example.com", Type: "A", Server: "192.0.2.2", Description: opnsense.ManagedDescriptionMarker})
+	// proxy2's alias is listed first, so deleting by FQDN would hit it instead of proxy1's
+	shared2 := server.AddAliasOverride(opnsensetest.AliasOverride{Host: proxy2, Hostname: "shared", Domain: "example.com"})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: proxy1, Hostname: "shared", Domain: "example.com"})
+
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "ip": "192.0.2.1", "aliases": []}`, nil)
+	if status != http.StatusOK {
+		t.Fatalf("sync got status %v, want %v", status, http.StatusOK)
+	}
+	if aliases := server.AliasOverrides(); len(aliases) != 1 || aliases[0].UUID != shared2 {
+		t.Errorf("sync left alias overrides %+v, want the one of proxy2", aliases)
+	}
+}
+
+func Test_handleSyncAliasesRequest_force(t *testing.T) {
+	server := useTestOPNsense(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "nas", Domain: "example.com", Type: "A", Server: "10.0.0.50", Description: "made by hand"})
+	body := `{"host": "nas.example.com", "ip": "10.0.0.60"}`
+
+	var response syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync", body, &response)
+	if status != http.StatusConflict || len(response.Errors) != 1 || response.Errors[0].Step != "validate" {
+		t.Errorf("sync of a record made by hand got status %v and %+v, want %v", status, response, http.StatusConflict)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].Server != "10.0.0.50" {
+		t.Errorf("sync without force changed the host overrides to %+v", hosts)
+	}
+
+	response = syncAliasesResponse{}
+	status = serveTestRequest(t, http.MethodPost, "/sync?force=true", body, &response)
+	if status != http.StatusOK {
+		t.Errorf("sync with force got status %v and %+v, want %v", status, response, http.StatusOK)
+	}
+	hosts := server.HostOverrides()
+	if len(hosts) != 1 || hosts[0].Server != "10.0.0.60" || !strings.Contains(hosts[0].Description, opnsense.ManagedDescriptionMarker) {
+		t.Errorf("sync with force got host overrides %+v, want nas.example.com at 10.0.0.60 created by OPNsenseProxyAPI", hosts)
+	}
+}
+
+func Test_handleGetHostRequests(t *testing.T) {
+	server := useTestOPNsense(t)
+	proxy1 := server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "example.com", Type: "A", Server: "10.0.0.5", Description: opnsense.ManagedDescriptionMarker})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "example.com", Type: "AAAA", Server: "fd00::5", Description: "added by hand"})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy2", Domain: "example.com", Type: "A", Server: "10.0.0.6", Description: opnsense.ManagedDescriptionMarker})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "manual", Domain: "example.com", Type: "A", Server: "10.0.0.7", Description: "added by hand"})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: proxy1, Hostname: "app1", Domain: "example.com", Description: opnsense.ManagedDescriptionMarker})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: proxy1, Hostname: "manual-alias", Domain: "example.com", Description: "added by hand"})
+	apiTokens = []apiToken{
+		{token: "all", allowedHosts: []string{"*.example.com"}},
+		{token: "proxy1", allowedHosts: []string{"proxy1.example.com"}},
+	}
+	t.Cleanup(func() { apiTokens = nil })
+
+	tests := []struct {
+		name       string
+		target     string
+		token      string
+		wantStatus int
+		// want lists the FQDNs of the returned overrides, or the type and server of the records of a host
+		want []string
+	}{
+		{name: "List hosts", target: "/hosts", token: "all", wantStatus: http.StatusOK, want: []string{"manual.example.com", "proxy1.example.com", "proxy1.example.com", "proxy2.example.com"}},
+		{name: "List managed hosts", target: "/hosts?managed=true", token: "all", wantStatus: http.StatusOK, want: []string{"proxy1.example.com", "proxy2.example.com"}},
+		{name: "List hosts of token", target: "/hosts", token: "proxy1", wantStatus: http.StatusOK, want: []string{"proxy1.example.com", "proxy1.example.com"}},
+		{name: "List hosts without token", target: "/hosts", wantStatus: http.StatusUnauthorized},
+		{name: "List hosts with invalid managed", target: "/hosts?managed=maybe", token: "all", wantStatus: http.StatusBadRequest},
+		{name: "Get host", target: "/hosts/proxy1.example.com", token: "proxy1", wantStatus: http.StatusOK, want: []string{"A 10.0.0.5", "AAAA fd00::5"}},
+		{name: "Get managed records of host", target: "/hosts/proxy1.example.com?managed=true", token: "proxy1", wantStatus: http.StatusOK, want: []string{"A 10.0.0.5"}},
+		{name: "Get unmanaged host with managed", target: "/hosts/manual.example.com?managed=true", token: "all", wantStatus: http.StatusNotFound},
+		{name: "Get missing host", target: "/hosts/missing.example.com", token: "all", wantStatus: http.StatusNotFound},
+		{name: "Get host of other token", target: "/hosts/proxy2.example.com", token: "proxy1", wantStatus: http.StatusForbidden},
+		{name: "List aliases", target: "/hosts/proxy1.example.com/aliases", token: "proxy1", wantStatus: http.StatusOK, want: []string{"app1.example.com", "manual-alias.example.com"}},
+		{name: "List managed aliases", target: "/hosts/proxy1.example.com/aliases?managed=true", token: "proxy1", wantStatus: http.StatusOK, want: []string{"app1.example.com"}},
+		{name: "List aliases of host without aliases", target: "/hosts/proxy2.example.com/aliases", token: "all", wantStatus: http.StatusOK, want: []string{}},
+		{name: "List aliases of missing host", target: "/hosts/missing.example.com/aliases", token: "all", wantStatus: http.StatusNotFound},
+		{name: "List aliases of host of other token", target: "/hosts/proxy2.example.com/aliases", token: "proxy1", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body json.RawMessage
+			status := serveTestRequestWithToken(t, http.MethodGet, tt.target, tt.token, "", &body)
+			if status != tt.wantStatus {
+				t.Fatalf("GET %v got status %v, want %v", tt.target, status, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				var response errorResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Error == "" {
+					t.Errorf("GET %v got %s, want an error response", tt.target, body)
+				}
+				return
+			}
+			got := []string{}
+			var host hostView
+			var views []struct {
+				FQDN string `json:"fqdn"`
+			}
+			if err := json.Unmarshal(body, &views); err == nil {
+				for _, view := range views {
+					got = append(got, view.FQDN)
+				}
+			} else if err := json.Unmarshal(body, &host); err == nil {
+				for _, record := range host.Records {
+					got = append(got, record.Type+" "+record.Server)
+				}
+			} else {
+				t.Fatalf("decoding %s: %v", body, err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GET %v got %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_forbiddenRequests(t *testing.T) {
+	useTestOPNsense(t)
+	apiTokens = []apiToken{{token: "proxy1", allowedHosts: []string{"proxy1.example.com"}}}
+	t.Cleanup(func() { apiTokens = nil })
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "Sync host of other token", method: http.MethodPost, target: "/sync", body: `{"host": "proxy2.example.com"}`},
+		{name: "Sync alias of other token", method: http.MethodPost, target: "/sync", body: `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`},
+		{name: "Delete host of other token", method: http.MethodDelete, target: "/hosts/proxy2.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Errors []syncStepError `json:"errors"`
+			}
+			status := serveTestRequestWithToken(t, tt.method, tt.target, "proxy1", tt.body, &response)
+			if status != http.StatusForbidden || len(response.Errors) != 1 || response.Errors[0].Step != "authorize" {
+				t.Errorf("%v %v got status %v and errors %+v, want %v with step authorize", tt.method, tt.target, status, response.Errors, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func Test_handleSyncAliasesRequest_wait(t *testing.T) {
+	server := useTestOPNsense(t)
+	targets[0].scheduler = opnsense.NewReconfigureScheduler(targets[0].client, 200*time.Millisecond, time.Second)
+	targets[0].client = targets[0].scheduler.Client()
+
+	var scheduled syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`, &scheduled)
+	if status != http.StatusOK || scheduled.Targets[0].Reconfigured || !scheduled.Targets[0].ReconfigurePending {
+		t.Errorf("sync got status %v and %+v, want pending reconfiguration", status, scheduled)
+	}
+	var waited syncAliasesResponse
+	status = serveTestRequest(t, http.MethodPost, "/sync?wait=true", `{"host": "proxy2.example.com", "ip": "10.0.0.6", "aliases": ["app2.example.com"]}`, &waited)
+	if status != http.StatusOK || !waited.Targets[0].Reconfigured || waited.Targets[0].ReconfigurePending {
+		t.Errorf("sync?wait=true got status %v and %+v, want reconfiguration", status, waited)
+	}
+	if got := server.Reconfigures(); got != 1 {
+		t.Errorf("syncs reconfigured %v times, want 1", got)
+	}
+}
+
+func Test_handleSyncAliasesRequest_domains(t *testing.T) {
+	server := useTestOPNsense(t)
+	domains = []string{"example.com", "lab.example.com"}
+
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.lab.example.com", "aliases": ["app1.example.com", "app1.lab.example.com"]}`, nil)
+	if status != http.StatusOK {
+		t.Fatalf("sync got status %v", status)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].Hostname != "proxy1" || hosts[0].Domain != "lab.example.com" {
+		t.Errorf("sync created host overrides %+v, want proxy1 in lab.example.com", hosts)
+	}
+	var got []string
+	for _, alias := range server.AliasOverrides() {
+		got = append(got, alias.Hostname+" "+alias.Domain)
+	}
+	if want := []string{"app1 example.com", "app1 lab.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sync created aliases %v, want %v", got, want)
+	}
+
+	for _, body := range []string{
+		`{"host": "proxy1.example.net"}`,
+		`{"host": "proxy1.example.com", "aliases": ["app1.example.net"]}`,
+	} {
+		var response syncAliasesResponse
+		status := serveTestRequest(t, http.MethodPost, "/sync", body, &response)
+		if status != http.StatusBadRequest || len(response.Errors) != 1 || response.Errors[0].Step != "validate" {
+			t.Errorf("sync of %v got status %v and %+v, want %v", body, status, response, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_handleSyncAliasesRequest_canonicalFQDN(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		host string
+	}{
+		{name: "Upper case", body: `{"host": "proxy3.EXAMPLE.com", "aliases": ["App3.example.com"]}`, host: "proxy3.example.com"},
+		{name: "Trailing dot", body: `{"host": "proxy2.example.com.", "aliases": ["app2.example.com."]}`, host: "proxy2.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := useTestOPNsense(t)
+			for i := 0; i < 2; i++ {
+				var response syncAliasesResponse
+				status := serveTestRequest(t, http.MethodPost, "/sync", tt.body, &response)
+				if status != http.StatusOK || response.Host != tt.host {
+					t.Fatalf("sync %v got status %v and %+v, want host %v", i+1, status, response, tt.host)
+				}
+			}
+			if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].FQDN() != tt.host {
+				t.Errorf("syncs left host overrides %+v, want one for %v", hosts, tt.host)
+			}
+			if aliases := server.AliasOverrides(); len(aliases) != 1 || aliases[0].FQDN() != strings.Replace(tt.host, "proxy", "app", 1) {
+				t.Errorf("syncs left aliases %+v, want one lower case alias", aliases)
+			}
+			if _, found := store.Get(tt.host); !found || len(store.Hosts()) != 1 {
+				t.Errorf("syncs stored hosts %+v, want only %v", store.Hosts(), tt.host)
+			}
+		})
+	}
+}
+
+func Test_handleSyncAliasesRequest_concurrent(t *testing.T) {
+	server := useTestOPNsense(t)
+	body := `{"host": "proxy1.example.com", "aliases": ["app1.example.com", "app2.example.com"]}`
+	var wg sync.WaitGroup
+	statuses := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- serveTestRequest(t, http.MethodPost, "/sync", body, nil)
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("concurrent sync got status %v", status)
+		}
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 1 {
+		t.Errorf("concurrent syncs left host overrides %v, want one", hosts)
+	}
+	if aliases := server.AliasOverrides(); len(aliases) != 2 {
+		t.Errorf("concurrent syncs left aliases %v, want two", aliases)
+	}
+}
+
+func Test_handleSyncAliasesRequest_duplicates(t *testing.T) {
+	server := useTestOPNsense(t)
+	server.AddHostOverride(opnsensetest.HostOverride{UUID: "first", Hostname: "proxy1", Domain: "example.com", Type: "A", Server: "10.0.0.4", Description: opnsense.ManagedDescriptionMarker})
+	server.AddHostOverride(opnsensetest.HostOverride{UUID: "second", Hostname: "proxy1", Domain: "example.com", Type: "A", Server: "10.0.0.5", Description: opnsense.ManagedDescriptionMarker})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: "first", Hostname: "app1", Domain: "example.com"})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: "second", Hostname: "app1", Domain: "example.com"})
+
+	var response syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`, &response)
+	want := []hostOverrideChange{
+		{Type: "A", Server: "10.0.0.5", Action: hostOverrideUnchanged},
+		{Type: "A", Server: "10.0.0.4", Action: hostOverrideDeleted, Duplicate: true},
+	}
+	if status != http.StatusOK || !reflect.DeepEqual(response.Targets[0].HostOverrides, want) {
+		t.Errorf("sync got status %v and host overrides %+v, want %+v", status, response.Targets[0].HostOverrides, want)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].UUID != "second" {
+		t.Errorf("sync left host overrides %v, want only the one with the requested IP", hosts)
+	}
+	if aliases := server.AliasOverrides(); len(aliases) != 1 || aliases[0].Host != "second" {
+		t.Errorf("sync left aliases %v, want one for the remaining host override", aliases)
+	}
+}
+
+func Test_handleSyncAliasesRequest_unmanagedRecords(t *testing.T) {
+	server := useTestOPNsense(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "example.com", Type: "A", Server: "10.0.0.5", Description: opnsense.ManagedDescriptionMarker})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "example.com", Type: "A", Server: "10.0.0.6", Description: "made by hand"})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "example.com", Type: "AAAA", Server: "fd00::6"})
+
+	var response syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "addresses": ["10.0.0.5"]}`, &response)
+	want := []hostOverrideChange{
+		{Type: "A", Server: "10.0.0.5", Action: hostOverrideUnchanged},
+		{Type: "AAAA", Server: "fd00::6", Action: hostOverrideUnchanged},
+		{Type: "A", Server: "10.0.0.6", Action: hostOverrideUnchanged, Duplicate: true},
+	}
+	if status != http.StatusOK || !reflect.DeepEqual(response.Targets[0].HostOverrides, want) {
+		t.Errorf("sync got status %v and host overrides %+v, want %+v", status, response.Targets[0].HostOverrides, want)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 3 {
+		t.Errorf("sync left host overrides %v, want the unmanaged ones kept", hosts)
+	}
+}
+
+func Test_handleSyncAliasesRequest_ownedHost(t *testing.T) {
+	server := useTestOPNsense(t)
+	_ = store.Put(desiredHost{Host: "proxy1.example.com", Addresses: []string{"10.0.0.9"}, Owner: "docker"})
+
+	var response syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`, &response)
+	if status != http.StatusConflict || len(response.Errors) != 1 || response.Errors[0].Step != "validate" {
+		t.Errorf("sync of a host owned by docker got status %v and %+v, want %v", status, response, http.StatusConflict)
+	}
+	if host, _ := store.Get("proxy1.example.com"); host.Owner != "docker" {
+		t.Errorf("sync changed the owner of proxy1.example.com to %q", host.Owner)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 0 {
+		t.Errorf("sync created host overrides %v", hosts)
+	}
+}
+
+func Test_handleSyncAliasesRequest_targets(t *testing.T) {
+	body := `{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`
+	tests := []struct {
+		name          string
+		mode          string
+		wantStatus    int
+		wantOnPrimary int
+	}{
+		{name: "All targets must succeed", mode: syncModeAll, wantStatus: http.StatusBadGateway, wantOnPrimary: 0},
+		{name: "Best effort", mode: syncModeBestEffort, wantStatus: http.StatusOK, wantOnPrimary: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := useTestTargets(t, "primary", "secondary")
+			syncMode = tt.mode
+			servers[1].InjectFault("searchHostOverride", opnsensetest.Fault{Status: http.StatusInternalServerError})
+
+			var response syncAliasesResponse
+			status := serveTestRequest(t, http.MethodPost, "/sync", body, &response)
+			if status != tt.wantStatus || len(response.Targets) != 2 || len(response.Targets[1].Errors) != 1 {
+				t.Errorf("sync got status %v and %+v, want %v", status, response, tt.wantStatus)
+			}
+			if got := len(servers[0].HostOverrides()); got != tt.wantOnPrimary {
+				t.Errorf("sync created %v host overrides on the primary, want %v", got, tt.wantOnPrimary)
+			}
+			if _, stored := store.Get("proxy1.example.com"); stored != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("sync stored the desired state = %v, want %v", stored, tt.wantStatus == http.StatusOK)
+			}
+		})
+	}
+
+	servers := useTestTargets(t, "primary", "secondary")
+	var synced syncAliasesResponse
+	status := serveTestRequest(t, http.MethodPost, "/sync", body, &synced)
+	if status != http.StatusOK || !synced.Targets[0].Reconfigured || !synced.Targets[1].Reconfigured {
+		t.Fatalf("sync got status %v and %+v", status, synced)
+	}
+	for _, server := range servers {
+		if len(server.HostOverrides()) != 1 || len(server.AliasOverrides()) != 1 {
+			t.Errorf("sync left host overrides %v and aliases %v", server.HostOverrides(), server.AliasOverrides())
+		}
+	}
+	var views []hostOverrideView
+	if status := serveTestRequest(t, http.MethodGet, "/hosts?target=secondary", "", &views); status != http.StatusOK || len(views) != 1 {
+		t.Errorf("GET /hosts?target=secondary got status %v and %v", status, views)
+	}
+	if status := serveTestRequest(t, http.MethodGet, "/hosts?target=other", "", nil); status != http.StatusBadRequest {
+		t.Errorf("GET /hosts?target=other got status %v, want %v", status, http.StatusBadRequest)
+	}
+	// a host missing on one target is still deleted from the others
+	response := newTargetDeleteResult("secondary")
+	if failure := deleteHost(context.Background(), targets[1].client, "proxy1.example.com", false, response); failure != nil {
+		t.Fatalf("deleteHost() error = %v", failure)
+	}
+	var deleted deleteHostResponse
+	status = serveTestRequest(t, http.MethodDelete, "/hosts/proxy1.example.com", "", &deleted)
+	if status != http.StatusOK || len(deleted.Targets[0].HostOverrides) != 1 || len(servers[0].HostOverrides()) != 0 {
+		t.Errorf("DELETE got status %v and %+v", status, deleted)
+	}
+}
+
+func Test_handleDeleteHostRequest(t *testing.T) {
+	server := useTestOPNsense(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "manual", Domain: "example.com", Type: "A", Server: "10.0.0.7", Description: "added by hand"})
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "addresses": ["10.0.0.5", "fd00::5"], "aliases": ["app1.example.com"]}`, nil)
+	if status != http.StatusOK || len(server.AliasOverrides()) != 2 {
+		t.Fatalf("sync got status %v and aliases %v", status, server.AliasOverrides())
+	}
+
+	var views []hostOverrideView
+	status = serveTestRequest(t, http.MethodGet, "/hosts?managed=true", "", &views)
+	if status != http.StatusOK || len(views) != 2 {
+		t.Errorf("GET /hosts?managed=true got status %v and %v", status, views)
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{name: "Delete unmanaged host", target: "/hosts/manual.example.com", wantStatus: http.StatusConflict},
+		{name: "Force delete unmanaged host", target: "/hosts/manual.example.com?force=true", wantStatus: http.StatusOK},
+		{name: "Delete managed host", target: "/hosts/proxy1.example.com", wantStatus: http.StatusOK},
+		{name: "Delete missing host", target: "/hosts/proxy1.example.com", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response deleteHostResponse
+			status := serveTestRequest(t, http.MethodDelete, tt.target, "", &response)
+			if status != tt.wantStatus {
+				t.Errorf("DELETE %v got status %v, want %v: %+v", tt.target, status, tt.wantStatus, response)
+			}
+		})
+	}
+	if len(server.HostOverrides()) != 0 || len(server.AliasOverrides()) != 0 {
+		t.Errorf("DELETE left host overrides %v and aliases %v", server.HostOverrides(), server.AliasOverrides())
+	}
+}
+
+func Test_reconciler(t *testing.T) {
+	server := useTestOPNsense(t)
+	var err error
+	store, err = loadStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("loadStateStore() error = %v", err)
+	}
+	status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com", "app2.example.com"]}`, nil)
+	if status != http.StatusOK {
+		t.Fatalf("sync got status %v", status)
+	}
+	// drift: an alias is deleted by hand
+	aliases := server.AliasOverrides()
+	_, err = targets[0].client.DeleteAliasOverride(aliases[0].FQDN())
+	if err != nil {
+		t.Fatalf("DeleteAliasOverride() error = %v", err)
+	}
+
+	reloaded, err := loadStateStore(store.path)
+	if err != nil {
+		t.Fatalf("loadStateStore() error = %v", err)
+	}
+	rec := newReconciler(reloaded, time.Minute)
+	report := rec.reconcile(context.Background())
+	if len(report.Hosts) != 1 || !report.Hosts[0].Drift || report.Hosts[0].Error != "" {
+		t.Fatalf("reconcile() got = %+v, want drift of proxy1.example.com", report)
+	}
+	if got := len(server.AliasOverrides()); got != 2 {
+		t.Errorf("reconcile() left %v aliases, want 2", got)
+	}
+	report = rec.reconcile(context.Background())
+	if report.Hosts[0].Drift {
+		t.Errorf("reconcile() of reconciled host got = %+v, want no drift", report.Hosts[0])
+	}
+}
+
+func Test_leaseExpirer(t *testing.T) {
+	server := useTestOPNsense(t)
+	for _, body := range []string{
+		`{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`,
+		`{"host": "proxy2.example.com", "ip": "10.0.0.6", "aliases": ["app2.example.com"]}`,
+	} {
+		status := serveTestRequest(t, http.MethodPost, "/sync", body, nil)
+		if status != http.StatusOK {
+			t.Fatalf("sync got status %v", status)
+		}
+	}
+	renewed, _ := store.Get("proxy2.example.com")
+	renewed.UpdatedAt = renewed.UpdatedAt.Add(time.Hour)
+	_ = store.Put(renewed)
+	// hosts of watchers and the ExternalDNS webhook are kept up to date or deleted by them and never expire
+	_ = store.Put(desiredHost{Host: "docker1.example.com", Addresses: []string{"10.0.0.40"}, Owner: "docker"})
+	_ = store.Put(desiredHost{Host: "app3.example.com", Addresses: []string{"10.0.0.41"}, Owner: webhookOwner})
+	reconfigures := server.Reconfigures()
+
+	expirer := newLeaseExpirer(store, time.Hour)
+	got := expirer.expire(context.Background(), time.Now().Add(90*time.Minute))
+	if !reflect.DeepEqual(got, []string{"proxy1.example.com"}) {
+		t.Errorf("expire() got = %v, want [proxy1.example.com]", got)
+	}
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].FQDN() != "proxy2.example.com" {
+		t.Errorf("expire() left host overrides %v", hosts)
+	}
+	if aliases := server.AliasOverrides(); len(aliases) != 1 || aliases[0].FQDN() != "app2.example.com" {
+		t.Errorf("expire() left aliases %v", aliases)
+	}
+	if got := server.Reconfigures() - reconfigures; got != 1 {
+		t.Errorf("expire() reconfigured %v times, want 1", got)
+	}
+	if _, ok := store.Get("proxy1.example.com"); ok {
+		t.Errorf("expire() kept the lease of proxy1.example.com")
+	}
+	for _, owned := range []string{"docker1.example.com", "app3.example.com"} {
+		if _, ok := store.Get(owned); !ok {
+			t.Errorf("expire() removed the desired state of %v, which has an owner", owned)
+		}
+	}
+}
+
+func Test_hostLocker(t *testing.T) {
+	locker := newHostLocker()
+	unlock, err := locker.lock(context.Background(), "proxy1.example.com")
+	if err != nil {
+		t.Fatalf("lock() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := locker.lock(ctx, "PROXY1.example.com"); err != context.DeadlineExceeded {
+		t.Errorf("lock() of held lock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	otherUnlock, err := locker.lock(context.Background(), "proxy2.example.com")
+	if err != nil {
+		t.Fatalf("lock() of other host error = %v", err)
+	}
+	otherUnlock()
+	unlock()
+	unlock()
+	if len(locker.locks) != 0 {
+		t.Errorf("released locks were kept: %v", locker.locks)
+	}
+}
+
+func Test_metrics(t *testing.T) {
+	server := useTestOPNsense(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "manual", Domain: "example.com", Type: "A", Server: "10.0.0.7", Description: "added by hand"})
+	syncs := testutil.ToFloat64(syncsTotal.WithLabelValues(syncOutcomeSuccess))
+	rejected := testutil.ToFloat64(syncsTotal.WithLabelValues(syncOutcomeRejected))
+	aliasesCreated := testutil.ToFloat64(aliasesCreatedTotal)
+	hostOverridesCreated := testutil.ToFloat64(hostOverridesCreatedTotal)
+	reconfigures := testutil.ToFloat64(reconfiguresTotal.WithLabelValues("default", "success"))
+
+	serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com", "app2.example.com"]}`, nil)
+	serveTestRequest(t, http.MethodPost, "/sync", `{"host": `, nil)
+	serveTestRequest(t, http.MethodGet, "/hosts", "", nil)
+	serveTestRequest(t, http.MethodGet, "/hosts/proxy1.example.com/aliases", "", nil)
+
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{name: "successful syncs", got: testutil.ToFloat64(syncsTotal.WithLabelValues(syncOutcomeSuccess)) - syncs, want: 1},
+		{name: "rejected syncs", got: testutil.ToFloat64(syncsTotal.WithLabelValues(syncOutcomeRejected)) - rejected, want: 1},
+		{name: "aliases created", got: testutil.ToFloat64(aliasesCreatedTotal) - aliasesCreated, want: 2},
+		{name: "host overrides created", got: testutil.ToFloat64(hostOverridesCreatedTotal) - hostOverridesCreated, want: 1},
+		{name: "reconfigures", got: testutil.ToFloat64(reconfiguresTotal.WithLabelValues("default", "success")) - reconfigures, want: 1},
+		{name: "managed host overrides", got: testutil.ToFloat64(managedHostOverrides.WithLabelValues("default")), want: 1},
+		{name: "managed alias overrides", got: testutil.ToFloat64(managedAliasOverrides.WithLabelValues("default")), want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+	if got := testutil.CollectAndCount(opnsenseRequestDuration); got == 0 {
+		t.Errorf("no latency of OPNsense requests was recorded")
+	}
+}
+
+func Test_leaseExpirer_timeout(t *testing.T) {
+	server := useTestOPNsense(t)
+	var hosts []string
+	for i := 1; i <= 5; i++ {
+		host := fmt.Sprintf("proxy%v.example.com", i)
+		status := serveTestRequest(t, http.MethodPost, "/sync", fmt.Sprintf(`{"host": %q}`, host), nil)
+		if status != http.StatusOK {
+			t.Fatalf("sync of %v got status %v", host, status)
+		}
+		hosts = append(hosts, host)
+	}
+	// every host takes a third of the timeout, so a timeout for all of them would fail the last ones
+	server.InjectFault("searchHostAlias", opnsensetest.Fault{Delay: 60 * time.Millisecond})
+
+	expirer := newLeaseExpirer(store, time.Hour)
+	expirer.timeout = 200 * time.Millisecond
+	got := expirer.expire(context.Background(), time.Now().Add(90*time.Minute))
+	if !reflect.DeepEqual(got, hosts) {
+		t.Errorf("expire() got = %v, want %v", got, hosts)
+	}
+	if left := server.HostOverrides(); len(left) != 0 {
+		t.Errorf("expire() left host overrides %v", left)
+	}
+}
+
+func Test_handleGetReconcileRequest(t *testing.T) {
+	server := useTestOPNsense(t)
+	for _, body := range []string{
+		`{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`,
+		`{"host": "proxy2.example.com", "ip": "10.0.0.6", "aliases": ["app2.example.com"]}`,
+	} {
+		if status := serveTestRequest(t, http.MethodPost, "/sync", body, nil); status != http.StatusOK {
+			t.Fatalf("sync got status %v", status)
+		}
+	}
+	if status := serveTestRequest(t, http.MethodGet, "/reconcile", "", nil); status != http.StatusNotFound {
+		t.Errorf("GET /reconcile with reconciliation disabled got status %v, want %v", status, http.StatusNotFound)
+	}
+
+	hostReconciler = newReconciler(store, time.Minute)
+	apiTokens = []apiToken{{token: "secret1", allowedHosts: []string{"proxy1.example.com"}}}
+	t.Cleanup(func() {
+		hostReconciler = nil
+		apiTokens = nil
+	})
+	if status := serveTestRequestWithToken(t, http.MethodGet, "/reconcile", "secret1", "", nil); status != http.StatusNotFound {
+		t.Errorf("GET /reconcile before the first reconciliation got status %v, want %v", status, http.StatusNotFound)
+	}
+	// drift: the aliases of both hosts are deleted by hand
+	for _, alias := range server.AliasOverrides() {
+		if _, err := targets[0].client.DeleteAliasOverride(alias.FQDN()); err != nil {
+			t.Fatalf("DeleteAliasOverride() error = %v", err)
+		}
+	}
+	hostReconciler.reconcile(context.Background())
+
+	var report reconcileReport
+	status := serveTestRequestWithToken(t, http.MethodGet, "/reconcile", "secret1", "", &report)
+	if status != http.StatusOK {
+		t.Fatalf("GET /reconcile got status %v, want %v", status, http.StatusOK)
+	}
+	if len(report.Hosts) != 1 || report.Hosts[0].Host != "proxy1.example.com" || !report.Hosts[0].Drift || report.Hosts[0].Plan == nil {
+		t.Errorf("GET /reconcile got hosts %+v, want only the drift of proxy1.example.com", report.Hosts)
+	}
+	if got := hostReconciler.LastReport(); len(got.Hosts) != 2 {
+		t.Errorf("LastReport() got hosts %+v, want both hosts", got.Hosts)
+	}
+}
+
+func Test_handleReadyzRequest(t *testing.T) {
+	server := useTestOPNsense(t)
+	readiness = newReadinessChecker(time.Second, time.Hour)
+	t.Cleanup(func() { readiness = newReadinessChecker(5*time.Second, 10*time.Second) })
+
+	var health healthResponse
+	if status := serveTestRequest(t, http.MethodGet, "/healthz", "", &health); status != http.StatusOK || health.Status != "ok" {
+		t.Errorf("GET /healthz got status %v and %+v", status, health)
+	}
+	var ready readinessResponse
+	if status := serveTestRequest(t, http.MethodGet, "/readyz", "", &ready); status != http.StatusOK || !ready.Ready {
+		t.Errorf("GET /readyz got status %v and %+v", status, ready)
+	}
+	apiSecret := server.APISecret
+	server.APISecret = "other"
+	if status := serveTestRequest(t, http.MethodGet, "/readyz", "", &ready); status != http.StatusOK || server.Calls("searchHostOverride") != 1 {
+		t.Errorf("GET /readyz within cache duration got status %v and probed OPNsense %v times", status, server.Calls("searchHostOverride"))
+	}
+
+	readiness = newReadinessChecker(time.Second, 0)
+	var notReady readinessResponse
+	status := serveTestRequest(t, http.MethodGet, "/readyz", "", &notReady)
+	if status != http.StatusServiceUnavailable || notReady.Ready || notReady.Reason != opnsense.FailureAuth {
+		t.Errorf("GET /readyz with wrong credentials got status %v and %+v", status, notReady)
+	}
+
+	server.APISecret = apiSecret
+	readiness = newReadinessChecker(time.Second, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	newTestRouter().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+	if cached := readiness.check(time.Now()); !cached.Ready {
+		t.Errorf("readiness after a cancelled GET /readyz got %+v, want ready", cached)
+	}
+}
+
+func Test_accessLog(t *testing.T) {
+	useTestOPNsense(t)
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(accessLog)
+	r.Post("/sync", handleSyncAliasesRequest)
+
+	request := httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(`{"host": "proxy1.example.com", "aliases": ["app1.example.com"]}`))
+	request.RemoteAddr = "10.0.0.5:51234"
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("sync got status %v", recorder.Code)
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) < 3 {
+		t.Fatalf("sync logged %v lines, want host override, aliases and access log", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Data["request_id"] == "" || entry.Data["request_id"] == nil || entry.Data["ip"] != "10.0.0.5" {
+			t.Errorf("log line %q has fields %v, want request_id and ip", entry.Message, entry.Data)
+		}
+	}
+	for _, entry := range entries[:len(entries)-1] {
+		if entry.Data["host"] != "proxy1.example.com" || entry.Data["target"] != "default" {
+			t.Errorf("log line %q has fields %v, want host and target", entry.Message, entry.Data)
+		}
+	}
+	if access := hook.LastEntry(); access.Message != "Handled request" || access.Data["status"] != http.StatusOK || access.Data["path"] != "/sync" {
+		t.Errorf("access log got %q with fields %v", access.Message, access.Data)
+	}
+}
+
+func Test_configureLogging(t *testing.T) {
+	t.Cleanup(func() {
+		log.SetFormatter(&log.TextFormatter{})
+		log.SetLevel(log.InfoLevel)
+	})
+	tests := []struct {
+		format  string
+		level   string
+		wantErr bool
+	}{
+		{format: "", level: ""},
+		{format: "json", level: "debug"},
+		{format: "xml", level: "", wantErr: true},
+		{format: "text", level: "loud", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+" "+tt.level, func(t *testing.T) {
+			if err := configureLogging(tt.format, tt.level); (err != nil) != tt.wantErr {
+				t.Errorf("configureLogging() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// waitFor polls condition until it holds, failing the test after a second.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func aliasFQDNs(server *opnsensetest.Server) []string {
+	fqdns := []string{}
+	for _, alias := range server.AliasOverrides() {
+		fqdns = append(fqdns, alias.FQDN())
+	}
+	sort.Strings(fqdns)
+	return fqdns
+}
+
+func Test_dockerWatcher(t *testing.T) {
+	server := useTestOPNsense(t)
+	dockerServer, err := dockertest.NewServer(filepath.Join(t.TempDir(), "docker.sock"))
+	if err != nil {
+		t.Fatalf("dockertest.NewServer() error = %v", err)
+	}
+	t.Cleanup(dockerServer.Close)
+	dockerServer.StartContainer("app1", map[string]string{"opnsense.alias": "app1.example.com, app2.example.com"})
+	dockerServer.StartContainer("db", map[string]string{"other": "label"})
+
+	watcher, err := newDockerWatcher(watchConfig{Host: "docker1.example.com", Addresses: []string{"10.0.0.8"}, Docker: dockerWatchConfig{Host: "unix://" + dockerServer.SocketPath}})
+	if err != nil {
+		t.Fatalf("newDockerWatcher() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watcher.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "aliases of running containers", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app1.example.com", "app2.example.com"})
+	})
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].FQDN() != "docker1.example.com" || hosts[0].Server != "10.0.0.8" {
+		t.Errorf("watcher created host overrides %+v, want docker1.example.com with 10.0.0.8", hosts)
+	}
+	waitFor(t, "event stream", func() bool { return dockerServer.Subscribers() > 0 })
+
+	dockerServer.StartContainer("app3", map[string]string{"opnsense.alias": "app3.example.com,app3.example.net"})
+	waitFor(t, "alias of started container", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app1.example.com", "app2.example.com", "app3.example.com"})
+	})
+	dockerServer.StopContainer("app1")
+	waitFor(t, "deletion of the aliases of the stopped container", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app3.example.com"})
+	})
+	if host, ok := store.Get("docker1.example.com"); !ok || host.Owner != "docker" {
+		t.Errorf("watcher stored %+v, want desired state of docker1.example.com owned by docker", host)
+	}
+
+	if _, err := newDockerWatcher(watchConfig{Host: "docker1.example.net", Addresses: []string{"10.0.0.8"}}); err == nil {
+		t.Errorf("newDockerWatcher() of host outside the managed domains error = nil, want error")
+	}
+}
+
+func Test_traefikWatcher(t *testing.T) {
+	server := useTestOPNsense(t)
+	var mu sync.Mutex
+	routers := []map[string]string{
+		{"name": "app1@docker", "rule": "Host(`app1.example.com`) || Host(`app1.example.net`)", "status": "enabled"},
+		{"name": "app2@file", "rule": "Host(`app2.example.com`) && PathPrefix(`/api`)", "status": "disabled"},
+	}
+	traefikServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/api/http/routers" {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(routers)
+	}))
+	t.Cleanup(traefikServer.Close)
+
+	watcher, err := newTraefikWatcher(watchConfig{Host: "traefik1.example.com", Addresses: []string{"10.0.0.9"}, Traefik: traefikWatchConfig{URL: traefikServer.URL, PollInterval: "10ms"}})
+	if err != nil {
+		t.Fatalf("newTraefikWatcher() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watcher.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "hosts of enabled routers", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app1.example.com"})
+	})
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].FQDN() != "traefik1.example.com" || hosts[0].Server != "10.0.0.9" {
+		t.Errorf("watcher created host overrides %+v, want traefik1.example.com with 10.0.0.9", hosts)
+	}
+
+	mu.Lock()
+	routers = append(routers[1:], map[string]string{"name": "app3@docker", "rule": "Host(`app3.example.com`, `app4.example.com`)", "status": "enabled"})
+	mu.Unlock()
+	waitFor(t, "hosts of the new router", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app3.example.com", "app4.example.com"})
+	})
+
+	if _, err := newTraefikWatcher(watchConfig{Host: "traefik1.example.com", Addresses: []string{"10.0.0.9"}, Traefik: traefikWatchConfig{PollInterval: "soon"}}); err == nil {
+		t.Errorf("newTraefikWatcher() of invalid poll interval error = nil, want error")
+	}
+}
+
+func Test_caddyWatcher(t *testing.T) {
+	server := useTestOPNsense(t)
+	caddyServer := caddytest.NewServer()
+	t.Cleanup(caddyServer.Close)
+	caddyServer.SetConfig(`{"apps": {"http": {"servers": {"srv0": {"routes": [
+		{"match": [{"host": ["app1.example.com", "app1.example.net", "*.example.com"]}]}
+	]}}}}}`)
+
+	watcher, err := newCaddyWatcher(watchConfig{Host: "caddy1.example.com", Addresses: []string{"10.0.0.10"}, Caddy: caddyWatchConfig{URL: caddyServer.URL, PollInterval: "10ms"}})
+	if err != nil {
+		t.Fatalf("newCaddyWatcher() error = %v", err)
+	}
+	watcher.watcher.retryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watcher.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "hosts of the running config", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app1.example.com"})
+	})
+	if hosts := server.HostOverrides(); len(hosts) != 1 || hosts[0].FQDN() != "caddy1.example.com" || hosts[0].Server != "10.0.0.10" {
+		t.Errorf("watcher created host overrides %+v, want caddy1.example.com with 10.0.0.10", hosts)
+	}
+
+	// a failing admin API leaves the aliases in place until the config can be read again
+	caddyServer.SetStatus(http.StatusInternalServerError)
+	requests := caddyServer.Requests()
+	waitFor(t, "failed config reads", func() bool { return caddyServer.Requests() > requests+1 })
+	if got := aliasFQDNs(server); !reflect.DeepEqual(got, []string{"app1.example.com"}) {
+		t.Errorf("aliases after failed config reads = %v, want [app1.example.com]", got)
+	}
+	caddyServer.SetConfig(`{"apps": {"http": {"servers": {"srv0": {"routes": [
+		{"match": [{"host": ["app2.example.com"]}], "handle": [{"handler": "subroute", "routes": [{"match": [{"host": ["app3.example.com"]}]}]}]}
+	]}}}}}`)
+	caddyServer.SetStatus(http.StatusOK)
+	waitFor(t, "hosts of the reloaded config", func() bool {
+		return reflect.DeepEqual(aliasFQDNs(server), []string{"app2.example.com", "app3.example.com"})
+	})
+}
+
+func Test_kubeController(t *testing.T) {
+	const (
+		ingresses  = "networking.k8s.io/v1/ingresses"
+		httpRoutes = "gateway.networking.k8s.io/v1/httproutes"
+		gateways   = "gateway.networking.k8s.io/v1/gateways"
+	)
+	startController := func(t *testing.T, cfg watchConfig) {
+		controller, err := newKubeController(cfg)
+		if err != nil {
+			t.Fatalf("newKubeController() error = %v", err)
+		}
+		controller.retryInterval = 10 * time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			controller.Run(ctx)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+	}
+	apply := func(t *testing.T, kubeServer *kubetest.Server, resource, object string) {
+		if err := kubeServer.Apply(resource, object); err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+	}
+	hostOverrides := func(server *opnsensetest.Server) map[string]string {
+		hosts := make(map[string]string)
+		for _, host := range server.HostOverrides() {
+			hosts[host.FQDN()] = host.Server
+		}
+		return hosts
+	}
+	gone := func(kubeServer *kubetest.Server, resource, namespace, name string) func() bool {
+		return func() bool {
+			_, found := kubeServer.Get(resource, namespace, name)
+			return !found
+		}
+	}
+
+	t.Run("aliases", func(t *testing.T) {
+		server := useTestOPNsense(t)
+		kubeServer := kubetest.NewServer()
+		t.Cleanup(kubeServer.Close)
+		// without the Gateway API, HTTPRoutes are skipped
+		kubeServer.AddResource(ingresses)
+		apply(t, kubeServer, ingresses, `{"metadata": {"name": "app1", "namespace": "default"}, "spec": {"rules": [{"host": "app1.example.com"}, {"host": "app1.example.net"}]}}`)
+		apply(t, kubeServer, ingresses, `{"metadata": {"name": "app2", "namespace": "web"}, "spec": {"rules": [{"host": "app2.example.com"}]}}`)
+
+		startController(t, watchConfig{Host: "k8s.example.com", Addresses: []string{"10.0.0.11"}, Kubernetes: kubernetesWatchConfig{APIURL: kubeServer.URL}})
+		waitFor(t, "aliases of the ingresses", func() bool {
+			return reflect.DeepEqual(aliasFQDNs(server), []string{"app1.example.com", "app2.example.com"})
+		})
+		if hosts := hostOverrides(server); !reflect.DeepEqual(hosts, map[string]string{"k8s.example.com": "10.0.0.11"}) {
+			t.Errorf("controller created host overrides %v, want k8s.example.com with 10.0.0.11", hosts)
+		}
+		waitFor(t, "finalizer", func() bool {
+			metadata, _ := kubeServer.Get(ingresses, "default", "app1")
+			return reflect.DeepEqual(metadata.Finalizers, []string{kubeFinalizer})
+		})
+
+		kubeServer.Delete(ingresses, "default", "app1")
+		waitFor(t, "deletion of the ingress", gone(kubeServer, ingresses, "default", "app1"))
+		if got := aliasFQDNs(server); !reflect.DeepEqual(got, []string{"app2.example.com"}) {
+			t.Errorf("aliases after deleting the ingress = %v, want [app2.example.com]", got)
+		}
+	})
+
+	t.Run("load balancer addresses", func(t *testing.T) {
+		server := useTestOPNsense(t)
+		kubeServer := kubetest.NewServer()
+		t.Cleanup(kubeServer.Close)
+		kubeServer.AddResource(ingresses)
+		kubeServer.AddResource(httpRoutes)
+		kubeServer.AddResource(gateways)
+		apply(t, kubeServer, ingresses, `{
+			"metadata": {"name": "app1", "namespace": "default"},
+			"spec": {"rules": [{"host": "app1.example.com"}]},
+			"status": {"loadBalancer": {"ingress": [{"ip": "10.0.0.20"}, {"ip": "10.0.0.30"}]}}
+		}`)
+		apply(t, kubeServer, ingresses, `{"metadata": {"name": "pending", "namespace": "default"}, "spec": {"rules": [{"host": "pending.example.com"}]}}`)
+		apply(t, kubeServer, gateways, `{"metadata": {"name": "gateway1", "namespace": "infra"}, "status": {"addresses": [{"type": "IPAddress", "value": "10.0.0.21"}]}}`)
+		apply(t, kubeServer, httpRoutes, `{
+			"metadata": {"name": "app2", "namespace": "web"},
+			"spec": {"hostnames": ["app2.example.com"], "parentRefs": [{"name": "gateway1", "namespace": "infra"}]}
+		}`)
+
+		startController(t, watchConfig{Kubernetes: kubernetesWatchConfig{APIURL: kubeServer.URL}})
+		waitFor(t, "host overrides of the ingress and the route", func() bool {
+			return reflect.DeepEqual(hostOverrides(server), map[string]string{"app1.example.com": "10.0.0.20", "app2.example.com": "10.0.0.21"})
+		})
+		waitFor(t, "hosts annotation", func() bool {
+			metadata, _ := kubeServer.Get(ingresses, "default", "pending")
+			return metadata.Annotations[kubeHostsAnnotation] == "pending.example.com"
+		})
+
+		apply(t, kubeServer, ingresses, `{
+			"metadata": {"name": "app1", "namespace": "default"},
+			"spec": {"rules": [{"host": "app3.example.com"}]},
+			"status": {"loadBalancer": {"ingress": [{"ip": "10.0.0.20"}]}}
+		}`)
+		waitFor(t, "host override of the renamed host", func() bool {
+			return reflect.DeepEqual(hostOverrides(server), map[string]string{"app3.example.com": "10.0.0.20", "app2.example.com": "10.0.0.21"})
+		})
+		waitFor(t, "hosts annotation of the renamed host", func() bool {
+			metadata, _ := kubeServer.Get(ingresses, "default", "app1")
+			return metadata.Annotations[kubeHostsAnnotation] == "app3.example.com"
+		})
+
+		kubeServer.Delete(httpRoutes, "web", "app2")
+		waitFor(t, "deletion of the route", gone(kubeServer, httpRoutes, "web", "app2"))
+		if hosts := hostOverrides(server); !reflect.DeepEqual(hosts, map[string]string{"app3.example.com": "10.0.0.20"}) {
+			t.Errorf("host overrides after deleting the route = %v, want app3.example.com", hosts)
+		}
+		if _, ok := store.Get("app2.example.com"); ok {
+			t.Errorf("controller kept the desired state of app2.example.com")
+		}
+	})
+
+	t.Run("hosts of others", func(t *testing.T) {
+		server := useTestOPNsense(t)
+		server.AddHostOverride(opnsensetest.HostOverride{Hostname: "manual", Domain: "example.com", Type: "A", Server: "10.0.0.7", Description: "added by hand"})
+		status := serveTestRequest(t, http.MethodPost, "/sync", `{"host": "proxy1.example.com", "aliases": ["app1.example.com", "app2.example.com"]}`, nil)
+		if status != http.StatusOK {
+			t.Fatalf("sync got status %v", status)
+		}
+		kubeServer := kubetest.NewServer()
+		t.Cleanup(kubeServer.Close)
+		kubeServer.AddResource(ingresses)
+		apply(t, kubeServer, ingresses, `{
+			"metadata": {"name": "app3", "namespace": "default"},
+			"spec": {"rules": [{"host": "proxy1.example.com"}, {"host": "manual.example.com"}, {"host": "app3.example.com"}]},
+			"status": {"loadBalancer": {"ingress": [{"ip": "10.0.0.99"}]}}
+		}`)
+
+		startController(t, watchConfig{Kubernetes: kubernetesWatchConfig{APIURL: kubeServer.URL}})
+		want := map[string]string{"proxy1.example.com": "10.0.0.5", "manual.example.com": "10.0.0.7", "app3.example.com": "10.0.0.99"}
+		waitFor(t, "host override of the ingress", func() bool {
+			return reflect.DeepEqual(hostOverrides(server), want)
+		})
+		kubeServer.Delete(ingresses, "default", "app3")
+		waitFor(t, "deletion of the ingress", gone(kubeServer, ingresses, "default", "app3"))
+		delete(want, "app3.example.com")
+		if hosts := hostOverrides(server); !reflect.DeepEqual(hosts, want) {
+			t.Errorf("host overrides after deleting the ingress = %v, want %v", hosts, want)
+		}
+		if got := aliasFQDNs(server); !reflect.DeepEqual(got, []string{"app1.example.com", "app2.example.com"}) {
+			t.Errorf("aliases after deleting the ingress = %v, want those of proxy1.example.com", got)
+		}
+		if host, ok := store.Get("proxy1.example.com"); !ok || host.Owner != "" {
+			t.Errorf("controller changed the desired state of proxy1.example.com to %+v", host)
+		}
+	})
+}
+
+func Test_webhook(t *testing.T) {
+	server := useTestOPNsense(t)
+	webhookServer := httptest.NewServer(newWebhookRouter())
+	t.Cleanup(webhookServer.Close)
+	request := func(t *testing.T, method, path, body string, wantStatus int, response any) {
+		t.Helper()
+		req, err := http.NewRequest(method, webhookServer.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("http.NewRequest() error = %v", err)
+		}
+		req.Header.Set("Accept", webhookMediaType)
+		req.Header.Set("Content-Type", webhookMediaType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v error = %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%v %v got status %v, want %v", method, path, resp.StatusCode, wantStatus)
+		}
+		if response != nil {
+			if contentType := resp.Header.Get("Content-Type"); contentType != webhookMediaType {
+				t.Errorf("%v %v got Content-Type %v, want %v", method, path, contentType, webhookMediaType)
+			}
+			if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+				t.Fatalf("decoding %v %v error = %v", method, path, err)
+			}
+		}
+	}
+	records := func(t *testing.T) []webhookEndpoint {
+		var endpoints []webhookEndpoint
+		request(t, http.MethodGet, "/records", "", http.StatusOK, &endpoints)
+		return endpoints
+	}
+	hostOverrides := func() []string {
+		var hosts []string
+		for _, host := range server.HostOverrides() {
+			hosts = append(hosts, host.FQDN()+" "+host.Server)
+		}
+		sort.Strings(hosts)
+		return hosts
+	}
+
+	var filter webhookDomainFilter
+	request(t, http.MethodGet, "/", "", http.StatusOK, &filter)
+	if !reflect.DeepEqual(filter.Include, []string{"example.com"}) {
+		t.Errorf("GET / got domain filter %+v, want example.com", filter)
+	}
+
+	var adjusted []webhookEndpoint
+	request(t, http.MethodPost, "/adjustendpoints", `[{"dnsName": "App1.example.com", "targets": ["10.0.0.40", "10.0.0.50"], "recordType": "A", "recordTTL": 300}]`, http.StatusOK, &adjusted)
+	if want := []webhookEndpoint{{DNSName: "app1.example.com", Targets: []string{"10.0.0.40"}, RecordType: "A"}}; !reflect.DeepEqual(adjusted, want) {
+		t.Errorf("POST /adjustendpoints got %+v, want %+v", adjusted, want)
+	}
+
+	request(t, http.MethodPost, "/records", `{"Create": [
+		{"dnsName": "www.example.com", "targets": ["app1.example.com"], "recordType": "CNAME"},
+		{"dnsName": "app1.example.com", "targets": ["10.0.0.40"], "recordType": "A"},
+		{"dnsName": "app1.example.com", "targets": ["fd00::40"], "recordType": "AAAA"}
+	]}`, http.StatusNoContent, nil)
+	if got, want := hostOverrides(), []string{"app1.example.com 10.0.0.40", "app1.example.com fd00::40"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("host overrides after create = %v, want %v", got, want)
+	}
+	if got := aliasFQDNs(server); !reflect.DeepEqual(got, []string{"www.example.com", "www.example.com"}) {
+		t.Errorf("aliases after create = %v, want www.example.com for both records", got)
+	}
+	wantRecords := []webhookEndpoint{
+		{DNSName: "app1.example.com", Targets: []string{"10.0.0.40"}, RecordType: "A"},
+		{DNSName: "app1.example.com", Targets: []string{"fd00::40"}, RecordType: "AAAA"},
+		{DNSName: "www.example.com", Targets: []string{"app1.example.com"}, RecordType: "CNAME"},
+	}
+	if got := records(t); !reflect.DeepEqual(got, wantRecords) {
+		t.Errorf("GET /records got %+v, want %+v", got, wantRecords)
+	}
+
+	request(t, http.MethodPost, "/records", `{
+		"UpdateOld": [{"dnsName": "app1.example.com", "targets": ["10.0.0.40"], "recordType": "A"}],
+		"UpdateNew": [{"dnsName": "app1.example.com", "targets": ["10.0.0.41"], "recordType": "A"}],
+		"Delete": [{"dnsName": "app1.example.com", "targets": ["fd00::40"], "recordType": "AAAA"}]
+	}`, http.StatusNoContent, nil)
+	if got, want := hostOverrides(), []string{"app1.example.com 10.0.0.41"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("host overrides after update = %v, want %v", got, want)
+	}
+
+	if err := store.Put(desiredHost{Host: "proxy1.example.com", Addresses: []string{"10.0.0.5"}}); err != nil {
+		t.Fatalf("store.Put() error = %v", err)
+	}
+	manual := server.AddHostOverride(opnsensetest.HostOverride{Hostname: "manual", Domain: "example.com", Type: "A", Server: "10.0.0.30"})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: manual, Hostname: "manual-alias", Domain: "example.com"})
+	failures := []struct {
+		name       string
+		changes    string
+		wantStatus int
+	}{
+		{name: "unsupported type", changes: `{"Create": [{"dnsName": "app1.example.com", "targets": ["\"heritage=external-dns\""], "recordType": "TXT"}]}`, wantStatus: http.StatusBadRequest},
+		{name: "unmanaged domain", changes: `{"Create": [{"dnsName": "app1.example.net", "targets": ["10.0.0.42"], "recordType": "A"}]}`, wantStatus: http.StatusBadRequest},
+		{name: "wrong address family", changes: `{"Create": [{"dnsName": "app2.example.com", "targets": ["fd00::42"], "recordType": "A"}]}`, wantStatus: http.StatusBadRequest},
+		{name: "CNAME to unknown host", changes: `{"Create": [{"dnsName": "www2.example.com", "targets": ["app2.example.com"], "recordType": "CNAME"}]}`, wantStatus: http.StatusBadRequest},
+		{name: "host of another client", changes: `{"Create": [{"dnsName": "proxy1.example.com", "targets": ["10.0.0.42"], "recordType": "A"}]}`, wantStatus: http.StatusConflict},
+		{name: "unmanaged host override", changes: `{"Create": [{"dnsName": "manual.example.com", "targets": ["10.0.0.42"], "recordType": "A"}]}`, wantStatus: http.StatusConflict},
+		{name: "unmanaged alias override", changes: `{"Create": [{"dnsName": "manual-alias.example.com", "targets": ["app1.example.com"], "recordType": "CNAME"}]}`, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			request(t, http.MethodPost, "/records", tt.changes, tt.wantStatus, nil)
+		})
+	}
+	if got := records(t); len(got) != 2 {
+		t.Errorf("GET /records after failed changes got %+v, want the A and CNAME records of app1.example.com", got)
+	}
+	if got, want := hostOverrides(), []string{"app1.example.com 10.0.0.41", "manual.example.com 10.0.0.30"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("host overrides after failed changes = %v, want %v", got, want)
+	}
+
+	request(t, http.MethodPost, "/records", `{"Delete": [
+		{"dnsName": "www.example.com", "targets": ["app1.example.com"], "recordType": "CNAME"},
+		{"dnsName": "app1.example.com", "targets": ["10.0.0.41"], "recordType": "A"}
+	]}`, http.StatusNoContent, nil)
+	if got, want := hostOverrides(), []string{"manual.example.com 10.0.0.30"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("host overrides after delete = %v, want %v", got, want)
+	}
+	if got := records(t); len(got) != 0 {
+		t.Errorf("GET /records after delete got %+v, want none", got)
+	}
+	if _, ok := store.Get("proxy1.example.com"); !ok {
+		t.Errorf("webhook removed the desired state of proxy1.example.com")
+	}
+}
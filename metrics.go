@@ -0,0 +1,105 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+const (
+	syncOutcomeSuccess  = "success"
+	syncOutcomeDryRun   = "dry_run"
+	syncOutcomeRejected = "rejected"
+	syncOutcomeFailed   = "failed"
+)
+
+var (
+	syncsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "opnsenseproxyapi_syncs_total",
+		Help: "Sync requests by outcome: success, dry_run, rejected (4xx) or failed (5xx).",
+	}, []string{"outcome"})
+	aliasesCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "opnsenseproxyapi_aliases_created_total",
+		Help: "Alias overrides created.",
+	})
+	aliasesDeletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "opnsenseproxyapi_aliases_deleted_total",
+		Help: "Alias overrides deleted.",
+	})
+	hostOverridesCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "opnsenseproxyapi_host_overrides_created_total",
+		Help: "Host overrides created.",
+	})
+	reconfiguresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "opnsenseproxyapi_reconfigures_total",
+		Help: "Reconfigurations of Unbound by target and result: success or error.",
+	}, []string{"target", "result"})
+	opnsenseRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "opnsenseproxyapi_opnsense_request_duration_seconds",
+		Help:    "Latency of requests to OPNsense by target, API call and HTTP status code, which is \"error\" when no response was received.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target", "endpoint", "code"})
+	managedHostOverrides = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opnsenseproxyapi_managed_host_overrides",
+		Help: "Host overrides created by OPNsenseProxyAPI in the last list of host overrides of a target.",
+	}, []string{"target"})
+	managedAliasOverrides = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opnsenseproxyapi_managed_alias_overrides",
+		Help: "Alias overrides created by OPNsenseProxyAPI in the last list of alias overrides of a target.",
+	}, []string{"target"})
+)
+
+// metricsObserver exports the requests of the opnsense.Client of a target and the overrides it lists.
+type metricsObserver struct {
+	target string
+}
+
+func (observer metricsObserver) ObserveRequest(endpoint string, status int, duration time.Duration, err error) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	opnsenseRequestDuration.WithLabelValues(observer.target, endpoint, code).Observe(duration.Seconds())
+	if endpoint == "reconfigure" {
+		result := "success"
+		if err != nil || status < 200 || status > 299 {
+			result = "error"
+		}
+		reconfiguresTotal.WithLabelValues(observer.target, result).Inc()
+	}
+}
+
+func (observer metricsObserver) ObserveHostOverrides(hostOverrides []opnsense.HostOverride) {
+	managed := 0
+	for _, hostOverride := range hostOverrides {
+		if hostOverride.IsManaged() {
+			managed++
+		}
+	}
+	managedHostOverrides.WithLabelValues(observer.target).Set(float64(managed))
+}
+
+func (observer metricsObserver) ObserveAliasOverrides(aliasOverrides []opnsense.AliasOverride) {
+	managed := 0
+	for _, aliasOverride := range aliasOverrides {
+		if aliasOverride.IsManaged() {
+			managed++
+		}
+	}
+	managedAliasOverrides.WithLabelValues(observer.target).Set(float64(managed))
+}
+
+func syncOutcome(status int, dryRun bool) string {
+	switch {
+	case status >= 500:
+		return syncOutcomeFailed
+	case status >= 400:
+		return syncOutcomeRejected
+	case dryRun:
+		return syncOutcomeDryRun
+	default:
+		return syncOutcomeSuccess
+	}
+}
@@ -1,27 +1,85 @@
 package opnsense
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
-	log "github.com/sirupsen/logrus"
 	"strings"
 )
 
 type Client interface {
 	CreateHostOverride(hostOverride HostOverride) (bool, error)
+	CreateHostOverrideContext(ctx context.Context, hostOverride HostOverride) (bool, error)
 	CreateAliasOverride(aliasOverride AliasOverride) (bool, error)
+	CreateAliasOverrideContext(ctx context.Context, aliasOverride AliasOverride) (bool, error)
 	GetHostOverrides() ([]HostOverride, error)
+	GetHostOverridesContext(ctx context.Context) ([]HostOverride, error)
 	GetAliasOverrides() ([]AliasOverride, error)
+	GetAliasOverridesContext(ctx context.Context) ([]AliasOverride, error)
 	GetAliasOverridesForHost(host string) ([]AliasOverride, error)
+	GetAliasOverridesForHostContext(ctx context.Context, host string) ([]AliasOverride, error)
 	GetHostOverride(fqdn string) (HostOverride, error)
+	GetHostOverrideContext(ctx context.Context, fqdn string) (HostOverride, error)
+	GetHostOverrideRecords(fqdn string) ([]HostOverride, error)
+	GetHostOverrideRecordsContext(ctx context.Context, fqdn string) ([]HostOverride, error)
 	GetAliasOverride(fqdn string) (AliasOverride, error)
+	GetAliasOverrideContext(ctx context.Context, fqdn string) (AliasOverride, error)
 	DoesHostOverrideExist(fqdn string) (bool, error)
+	DoesHostOverrideExistContext(ctx context.Context, fqdn string) (bool, error)
+	UpdateHostOverride(hostOverride HostOverride) (bool, error)
+	UpdateHostOverrideContext(ctx context.Context, hostOverride HostOverride) (bool, error)
 	DeleteHostOverride(fqdn string) (bool, error)
+	DeleteHostOverrideContext(ctx context.Context, fqdn string) (bool, error)
+	DeleteHostOverrideRecord(hostOverride HostOverride) (bool, error)
+	DeleteHostOverrideRecordContext(ctx context.Context, hostOverride HostOverride) (bool, error)
 	DeleteAliasOverride(fqdn string) (bool, error)
-	SyncAliases(host string, aliases []string, domain string) (bool, error)
+	DeleteAliasOverrideContext(ctx context.Context, fqdn string) (bool, error)
+	DeleteAliasOverrideRecord(aliasOverride AliasOverride) (bool, error)
+	DeleteAliasOverrideRecordContext(ctx context.Context, aliasOverride AliasOverride) (bool, error)
+	PlanAliases(host string, aliases []string, domain string, records int) (AliasPlan, error)
+	PlanAliasesContext(ctx context.Context, host string, aliases []string, domain string, records int) (AliasPlan, error)
+	PlanAliasesInDomains(host string, aliases []string, domains []string, records int) (AliasPlan, error)
+	PlanAliasesInDomainsContext(ctx context.Context, host string, aliases []string, domains []string, records int) (AliasPlan, error)
+	ApplyAliasPlan(plan AliasPlan) (AliasSyncResult, error)
+	ApplyAliasPlanContext(ctx context.Context, plan AliasPlan) (AliasSyncResult, error)
+	SyncAliases(host string, aliases []string, domain string) (AliasSyncResult, error)
+	SyncAliasesContext(ctx context.Context, host string, aliases []string, domain string) (AliasSyncResult, error)
+	SyncAliasesInDomains(host string, aliases []string, domains []string) (AliasSyncResult, error)
+	SyncAliasesInDomainsContext(ctx context.Context, host string, aliases []string, domains []string) (AliasSyncResult, error)
 	Reconfigure() error
+	ReconfigureContext(ctx context.Context) error
+}
+
+// ErrNotFound is matched by errors.Is when a host or alias override does not exist.
+var ErrNotFound = errors.New("not found")
+
+type notFoundError struct {
+	kind string
+	fqdn string
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("%s %v does not exist", e.kind, e.fqdn)
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// StatusError is returned when OPNsense answers with an unexpected HTTP status, e.g. 401 for wrong credentials.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+func newStatusError(response *resty.Response) error {
+	return &StatusError{StatusCode: response.StatusCode(), Status: response.Status()}
 }
 
 type apiKeyClient struct {
@@ -29,11 +87,14 @@ type apiKeyClient struct {
 	apiSecret string
 	address   string
 	client    *resty.Client
+	observer  Observer
 }
 
+// NewClient creates a Client that verifies OPNsense against the CAs trusted by the system.
+// Use NewClientWithTLS for self-signed certificates.
 func NewClient(address, apiKey, apiSecret string) Client {
 	client := resty.New()
-	client.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	client.SetTLSClientConfig(&tls.Config{MinVersion: tls.VersionTLS12})
 	return &apiKeyClient{
 		apiKey:    apiKey,
 		apiSecret: apiSecret,
@@ -42,75 +103,192 @@ func NewClient(address, apiKey, apiSecret string) Client {
 	}
 }
 
-func (c *apiKeyClient) newRequest() *resty.Request {
-	request := c.client.R()
+func (c *apiKeyClient) newRequest(ctx context.Context) *resty.Request {
+	request := c.client.R().SetContext(ctx)
 	request.SetBasicAuth(c.apiKey, c.apiSecret)
 	return request
 }
 
+// The methods below call their Context variant with context.Background().
 func (c *apiKeyClient) CreateHostOverride(hostOverride HostOverride) (bool, error) {
+	return c.CreateHostOverrideContext(context.Background(), hostOverride)
+}
+
+func (c *apiKeyClient) UpdateHostOverride(hostOverride HostOverride) (bool, error) {
+	return c.UpdateHostOverrideContext(context.Background(), hostOverride)
+}
+
+func (c *apiKeyClient) CreateAliasOverride(aliasOverride AliasOverride) (bool, error) {
+	return c.CreateAliasOverrideContext(context.Background(), aliasOverride)
+}
+
+func (c *apiKeyClient) GetHostOverrides() ([]HostOverride, error) {
+	return c.GetHostOverridesContext(context.Background())
+}
+
+func (c *apiKeyClient) GetAliasOverrides() ([]AliasOverride, error) {
+	return c.GetAliasOverridesContext(context.Background())
+}
+
+func (c *apiKeyClient) GetAliasOverridesForHost(host string) ([]AliasOverride, error) {
+	return c.GetAliasOverridesForHostContext(context.Background(), host)
+}
+
+func (c *apiKeyClient) GetHostOverride(fqdn string) (HostOverride, error) {
+	return c.GetHostOverrideContext(context.Background(), fqdn)
+}
+
+func (c *apiKeyClient) GetHostOverrideRecords(fqdn string) ([]HostOverride, error) {
+	return c.GetHostOverrideRecordsContext(context.Background(), fqdn)
+}
+
+func (c *apiKeyClient) DoesHostOverrideExist(fqdn string) (bool, error) {
+	return c.DoesHostOverrideExistContext(context.Background(), fqdn)
+}
+
+func (c *apiKeyClient) GetAliasOverride(fqdn string) (AliasOverride, error) {
+	return c.GetAliasOverrideContext(context.Background(), fqdn)
+}
+
+func (c *apiKeyClient) DeleteHostOverride(fqdn string) (bool, error) {
+	return c.DeleteHostOverrideContext(context.Background(), fqdn)
+}
+
+func (c *apiKeyClient) DeleteHostOverrideRecord(hostOverride HostOverride) (bool, error) {
+	return c.DeleteHostOverrideRecordContext(context.Background(), hostOverride)
+}
+
+func (c *apiKeyClient) DeleteAliasOverride(fqdn string) (bool, error) {
+	return c.DeleteAliasOverrideContext(context.Background(), fqdn)
+}
+
+func (c *apiKeyClient) DeleteAliasOverrideRecord(aliasOverride AliasOverride) (bool, error) {
+	return c.DeleteAliasOverrideRecordContext(context.Background(), aliasOverride)
+}
+
+func (c *apiKeyClient) SyncAliases(host string, currentAliases []string, domain string) (AliasSyncResult, error) {
+	return c.SyncAliasesContext(context.Background(), host, currentAliases, domain)
+}
+
+func (c *apiKeyClient) SyncAliasesInDomains(host string, currentAliases []string, domains []string) (AliasSyncResult, error) {
+	return c.SyncAliasesInDomainsContext(context.Background(), host, currentAliases, domains)
+}
+
+func (c *apiKeyClient) PlanAliases(host string, currentAliases []string, domain string, records int) (AliasPlan, error) {
+	return c.PlanAliasesContext(context.Background(), host, currentAliases, domain, records)
+}
+
+func (c *apiKeyClient) PlanAliasesInDomains(host string, currentAliases []string, domains []string, records int) (AliasPlan, error) {
+	return c.PlanAliasesInDomainsContext(context.Background(), host, currentAliases, domains, records)
+}
+
+func (c *apiKeyClient) ApplyAliasPlan(plan AliasPlan) (AliasSyncResult, error) {
+	return c.ApplyAliasPlanContext(context.Background(), plan)
+}
+
+func (c *apiKeyClient) Reconfigure() error {
+	return c.ReconfigureContext(context.Background())
+}
+
+func (c *apiKeyClient) CreateHostOverrideContext(ctx context.Context, hostOverride HostOverride) (bool, error) {
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/addhostoverride", c.address)
-	response, err := c.newRequest().
+	response, err := c.newRequest(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetBody(addHostOverrideContainer{Host: hostOverride}).
+		SetResult(mutationResponse{}).
 		Post(endpoint)
 	if err != nil {
 		return false, err
 	}
-	return response.IsSuccess(), nil
+	// OPNsense answers failed validations with 200 and result "failed"
+	return response.IsSuccess() && response.Result().(*mutationResponse).Succeeded(), nil
 }
 
-func (c *apiKeyClient) CreateAliasOverride(aliasOverride AliasOverride) (bool, error) {
+// UpdateHostOverrideContext replaces the host override identified by hostOverride.UUID.
+func (c *apiKeyClient) UpdateHostOverrideContext(ctx context.Context, hostOverride HostOverride) (bool, error) {
+	if hostOverride.UUID == "" {
+		return false, fmt.Errorf("host override %v has no UUID", hostOverride.GetFQDN())
+	}
+	// search results describe the record type, which OPNsense does not accept when saving
+	hostOverride.Type = hostOverride.RecordType()
+	endpoint := fmt.Sprintf("%s/api/unbound/settings/setHostOverride/%s", c.address, hostOverride.UUID)
+	resp, err := c.newRequest(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(addHostOverrideContainer{Host: hostOverride}).
+		SetResult(mutationResponse{}).
+		Post(endpoint)
+	if err != nil {
+		return false, err
+	}
+	if !resp.IsSuccess() {
+		return false, newStatusError(resp)
+	}
+	result := resp.Result().(*mutationResponse)
+	if !result.Succeeded() {
+		return false, fmt.Errorf("host override %v was not saved: %v", hostOverride.GetFQDN(), result.Result)
+	}
+	return true, nil
+}
+
+func (c *apiKeyClient) CreateAliasOverrideContext(ctx context.Context, aliasOverride AliasOverride) (bool, error) {
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/addHostAlias", c.address)
 	if aliasOverride.IsHostFQDN() {
-		host, err := c.GetHostOverride(aliasOverride.Host)
+		host, err := c.GetHostOverrideContext(ctx, aliasOverride.Host)
 		if err != nil {
 			return false, err
 		}
 		aliasOverride.Host = host.UUID
 	}
-	response, err := c.newRequest().
+	response, err := c.newRequest(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetBody(addHostAliasContainer{Alias: aliasOverride}).
+		SetResult(mutationResponse{}).
 		Post(endpoint)
 	if err != nil {
 		return false, err
 	}
-	return response.IsSuccess(), nil
+	// OPNsense answers failed validations with 200 and result "failed"
+	return response.IsSuccess() && response.Result().(*mutationResponse).Succeeded(), nil
 }
 
-func (c *apiKeyClient) GetHostOverrides() ([]HostOverride, error) {
+func (c *apiKeyClient) GetHostOverridesContext(ctx context.Context) ([]HostOverride, error) {
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/searchHostOverride/", c.address)
-	resp, err := c.newRequest().SetResult(getHostOverridesContainer{}).Get(endpoint)
+	resp, err := c.newRequest(ctx).SetResult(getHostOverridesContainer{}).Get(endpoint)
 	if err != nil {
 		return nil, err
 	}
 	if !resp.IsSuccess() {
-		return nil, errors.New(resp.Status())
+		return nil, newStatusError(resp)
 	}
 	container := resp.Result().(*getHostOverridesContainer)
+	if c.observer != nil {
+		c.observer.ObserveHostOverrides(container.Rows)
+	}
 	return container.Rows, nil
 }
 
-func (c *apiKeyClient) GetAliasOverrides() ([]AliasOverride, error) {
+func (c *apiKeyClient) GetAliasOverridesContext(ctx context.Context) ([]AliasOverride, error) {
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/searchHostAlias", c.address)
-	resp, err := c.newRequest().SetResult(getHostAliasesContainer{}).Get(endpoint)
+	resp, err := c.newRequest(ctx).SetResult(getHostAliasesContainer{}).Get(endpoint)
 	if err != nil {
 		return nil, err
 	}
 	if !resp.IsSuccess() {
-		return nil, errors.New(resp.Status())
+		return nil, newStatusError(resp)
 	}
 	container := resp.Result().(*getHostAliasesContainer)
+	if c.observer != nil {
+		c.observer.ObserveAliasOverrides(container.Rows)
+	}
 	return container.Rows, nil
 }
 
-func (c *apiKeyClient) GetAliasOverridesForHost(host string) ([]AliasOverride, error) {
-	hostOverride, err := c.GetHostOverride(host)
+func (c *apiKeyClient) GetAliasOverridesForHostContext(ctx context.Context, host string) ([]AliasOverride, error) {
+	hostOverride, err := c.GetHostOverrideContext(ctx, host)
 	if err != nil {
 		return nil, err
 	}
-	aliasOverrides, err := c.GetAliasOverrides()
+	aliasOverrides, err := c.GetAliasOverridesContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -123,8 +301,8 @@ func (c *apiKeyClient) GetAliasOverridesForHost(host string) ([]AliasOverride, e
 	return aliasOverridesFromHost, nil
 }
 
-func (c *apiKeyClient) GetHostOverride(fqdn string) (HostOverride, error) {
-	allHostOverrides, err := c.GetHostOverrides()
+func (c *apiKeyClient) GetHostOverrideContext(ctx context.Context, fqdn string) (HostOverride, error) {
+	allHostOverrides, err := c.GetHostOverridesContext(ctx)
 	if err != nil {
 		return HostOverride{}, err
 	}
@@ -133,11 +311,40 @@ func (c *apiKeyClient) GetHostOverride(fqdn string) (HostOverride, error) {
 			return hostOverride, nil
 		}
 	}
-	return HostOverride{}, errors.New(fmt.Sprintf("Host override %v does not exist", fqdn))
+	return HostOverride{}, notFoundError{kind: "Host override", fqdn: fqdn}
 }
 
-func (c *apiKeyClient) DoesHostOverrideExist(fqdn string) (bool, error) {
-	allHostOverrides, err := c.GetHostOverrides()
+// GetHostOverrideRecordsContext returns every host override of fqdn, e.g. both the A and the AAAA record of a dual-stack host.
+func (c *apiKeyClient) GetHostOverrideRecordsContext(ctx context.Context, fqdn string) ([]HostOverride, error) {
+	allHostOverrides, err := c.GetHostOverridesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []HostOverride
+	for _, hostOverride := range allHostOverrides {
+		if fqdn == hostOverride.GetFQDN() {
+			records = append(records, hostOverride)
+		}
+	}
+	return records, nil
+}
+
+func (c *apiKeyClient) getAddressRecords(ctx context.Context, fqdn string) ([]HostOverride, error) {
+	records, err := c.GetHostOverrideRecordsContext(ctx, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	var addressRecords []HostOverride
+	for _, record := range records {
+		if record.IsAddressRecord() {
+			addressRecords = append(addressRecords, record)
+		}
+	}
+	return addressRecords, nil
+}
+
+func (c *apiKeyClient) DoesHostOverrideExistContext(ctx context.Context, fqdn string) (bool, error) {
+	allHostOverrides, err := c.GetHostOverridesContext(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -149,8 +356,8 @@ func (c *apiKeyClient) DoesHostOverrideExist(fqdn string) (bool, error) {
 	return false, nil
 }
 
-func (c *apiKeyClient) GetAliasOverride(fqdn string) (AliasOverride, error) {
-	allAliasOverrides, err := c.GetAliasOverrides()
+func (c *apiKeyClient) GetAliasOverrideContext(ctx context.Context, fqdn string) (AliasOverride, error) {
+	allAliasOverrides, err := c.GetAliasOverridesContext(ctx)
 	if err != nil {
 		return AliasOverride{}, err
 	}
@@ -159,29 +366,47 @@ func (c *apiKeyClient) GetAliasOverride(fqdn string) (AliasOverride, error) {
 			return aliasOverride, nil
 		}
 	}
-	return AliasOverride{}, errors.New(fmt.Sprintf("Alias override %v does not exist", fqdn))
+	return AliasOverride{}, notFoundError{kind: "Alias override", fqdn: fqdn}
 }
 
-func (c *apiKeyClient) DeleteHostOverride(fqdn string) (bool, error) {
-	hostOverride, err := c.GetHostOverride(fqdn)
+func (c *apiKeyClient) DeleteHostOverrideContext(ctx context.Context, fqdn string) (bool, error) {
+	hostOverride, err := c.GetHostOverrideContext(ctx, fqdn)
 	if err != nil {
 		return false, err
 	}
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/delHostOverride/%s", c.address, hostOverride.UUID)
-	return c.performDelete(fqdn, endpoint)
+	return c.performDelete(ctx, fqdn, endpoint)
 }
 
-func (c *apiKeyClient) DeleteAliasOverride(fqdn string) (bool, error) {
-	aliasOverride, err := c.GetAliasOverride(fqdn)
+// DeleteHostOverrideRecordContext deletes the host override identified by hostOverride.UUID.
+func (c *apiKeyClient) DeleteHostOverrideRecordContext(ctx context.Context, hostOverride HostOverride) (bool, error) {
+	if hostOverride.UUID == "" {
+		return false, fmt.Errorf("host override %v has no UUID", hostOverride.GetFQDN())
+	}
+	endpoint := fmt.Sprintf("%s/api/unbound/settings/delHostOverride/%s", c.address, hostOverride.UUID)
+	return c.performDelete(ctx, hostOverride.GetFQDN(), endpoint)
+}
+
+func (c *apiKeyClient) DeleteAliasOverrideContext(ctx context.Context, fqdn string) (bool, error) {
+	aliasOverride, err := c.GetAliasOverrideContext(ctx, fqdn)
 	if err != nil {
 		return false, err
 	}
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/delHostAlias/%s", c.address, aliasOverride.UUID)
-	return c.performDelete(fqdn, endpoint)
+	return c.performDelete(ctx, fqdn, endpoint)
+}
+
+// DeleteAliasOverrideRecordContext deletes the alias override identified by aliasOverride.UUID.
+func (c *apiKeyClient) DeleteAliasOverrideRecordContext(ctx context.Context, aliasOverride AliasOverride) (bool, error) {
+	if aliasOverride.UUID == "" {
+		return false, fmt.Errorf("alias override %v has no UUID", aliasOverride.GetFQDN())
+	}
+	endpoint := fmt.Sprintf("%s/api/unbound/settings/delHostAlias/%s", c.address, aliasOverride.UUID)
+	return c.performDelete(ctx, aliasOverride.GetFQDN(), endpoint)
 }
 
-func (c *apiKeyClient) performDelete(fqdn string, endpoint string) (bool, error) {
-	resp, err := c.newRequest().SetResult(deleteResponse{}).Post(endpoint)
+func (c *apiKeyClient) performDelete(ctx context.Context, fqdn string, endpoint string) (bool, error) {
+	resp, err := c.newRequest(ctx).SetResult(deleteResponse{}).Post(endpoint)
 	if err != nil {
 		return false, err
 	}
@@ -192,38 +417,131 @@ func (c *apiKeyClient) performDelete(fqdn string, endpoint string) (bool, error)
 	return true, nil
 }
 
-func (c *apiKeyClient) SyncAliases(host string, currentAliases []string, domain string) (bool, error) {
-	existingAliases, err := c.GetAliasOverridesForHost(host)
+// SyncAliasesContext syncs the aliases of host, which must all be in domain.
+func (c *apiKeyClient) SyncAliasesContext(ctx context.Context, host string, currentAliases []string, domain string) (AliasSyncResult, error) {
+	return c.SyncAliasesInDomainsContext(ctx, host, currentAliases, []string{domain})
+}
+
+// SyncAliasesInDomainsContext syncs the aliases of host, which may be in any of domains.
+func (c *apiKeyClient) SyncAliasesInDomainsContext(ctx context.Context, host string, currentAliases []string, domains []string) (AliasSyncResult, error) {
+	records, err := c.getAddressRecords(ctx, host)
 	if err != nil {
-		return false, err
+		return AliasSyncResult{Created: []string{}, Deleted: []string{}}, err
+	}
+	plan, err := c.PlanAliasesInDomainsContext(ctx, host, currentAliases, domains, len(records))
+	if err != nil {
+		return AliasSyncResult{Created: []string{}, Deleted: []string{}}, err
+	}
+	return c.ApplyAliasPlanContext(ctx, plan)
+}
+
+// PlanAliasesContext plans the aliases of host like PlanAliasesInDomainsContext, with every alias in domain.
+func (c *apiKeyClient) PlanAliasesContext(ctx context.Context, host string, currentAliases []string, domain string, records int) (AliasPlan, error) {
+	return c.PlanAliasesInDomainsContext(ctx, host, currentAliases, []string{domain}, records)
+}
+
+// PlanAliasesInDomainsContext computes the alias overrides to create and delete so that each of the given number of
+// host override records of host has exactly currentAliases, which may be in any of domains.
+// It only reads from OPNsense and also works for hosts that do not exist yet.
+func (c *apiKeyClient) PlanAliasesInDomainsContext(ctx context.Context, host string, currentAliases []string, domains []string, records int) (AliasPlan, error) {
+	plan := AliasPlan{Host: host, Domains: domains, Create: []string{}, Delete: []AliasOverride{}}
+	aliasOverrides, err := c.GetAliasOverridesContext(ctx)
+	if err != nil {
+		return plan, err
+	}
+	var existingAliases []AliasOverride
+	for _, alias := range aliasOverrides {
+		if alias.Host == host {
+			existingAliases = append(existingAliases, alias)
+		}
 	}
 	aliasesToCreate, aliasesToDelete := c.getAliasesToCreateAndDelete(currentAliases, existingAliases)
-	if len(aliasesToDelete) > 0 {
-		log.Infof("Deleting %v aliases for %v: [%v]", len(aliasesToDelete), host, strings.Join(aliasesToDelete, ", "))
+	aliasesToRecreate := c.getAliasesToRecreate(currentAliases, existingAliases, records)
+	plan.Create = append(plan.Create, aliasesToCreate...)
+	plan.Delete = append(plan.Delete, aliasesToDelete...)
+	for _, existingAlias := range existingAliases {
+		if aliasesToRecreate[existingAlias.GetFQDN()] {
+			plan.Delete = append(plan.Delete, existingAlias)
+		}
+	}
+	for _, currentAliasFQDN := range currentAliases {
+		if aliasesToRecreate[currentAliasFQDN] {
+			plan.Create = append(plan.Create, currentAliasFQDN)
+			delete(aliasesToRecreate, currentAliasFQDN)
+		}
 	}
-	if len(aliasesToCreate) > 0 {
-		log.Infof("Creating %v aliases for %v: [%v]", len(aliasesToCreate), host, strings.Join(aliasesToCreate, ", "))
+	return plan, nil
+}
+
+// getAliasesToRecreate returns the wanted aliases that do not exist exactly once per host override record.
+// Search results don't tell which record an alias belongs to, so these are deleted and created again for every record.
+func (c *apiKeyClient) getAliasesToRecreate(currentAliases []string, existingAliases []AliasOverride, records int) map[string]bool {
+	counts := make(map[string]int)
+	for _, existingAlias := range existingAliases {
+		counts[existingAlias.GetFQDN()]++
 	}
-	for _, aliasToCreate := range aliasesToCreate {
-		hostname := strings.Replace(aliasToCreate, fmt.Sprintf(".%v", domain), "", -1)
-		aliasOverride := NewAliasOverride(hostname, domain, host)
-		_, err = c.CreateAliasOverride(aliasOverride)
-		if err != nil {
-			return false, err
+	aliasesToRecreate := make(map[string]bool)
+	for _, currentAliasFQDN := range currentAliases {
+		count := counts[currentAliasFQDN]
+		if count > 0 && count != records {
+			aliasesToRecreate[currentAliasFQDN] = true
 		}
 	}
-	for _, aliasToDelete := range aliasesToDelete {
-		_, err = c.DeleteAliasOverride(aliasToDelete)
+	return aliasesToRecreate
+}
+
+// ApplyAliasPlanContext deletes and then creates the alias overrides listed in plan, stopping at the first error.
+// Aliases are deleted by UUID, so an alias with the same FQDN on another host is left alone.
+func (c *apiKeyClient) ApplyAliasPlanContext(ctx context.Context, plan AliasPlan) (AliasSyncResult, error) {
+	result := AliasSyncResult{Created: []string{}, Deleted: []string{}}
+	if len(plan.Delete) > 0 {
+		Logger(ctx).Infof("Deleting %v aliases for %v: [%v]", len(plan.Delete), plan.Host, strings.Join(plan.DeleteFQDNs(), ", "))
+	}
+	if len(plan.Create) > 0 {
+		Logger(ctx).Infof("Creating %v aliases for %v: [%v]", len(plan.Create), plan.Host, strings.Join(plan.Create, ", "))
+	}
+	for _, aliasToDelete := range plan.Delete {
+		_, err := c.DeleteAliasOverrideRecordContext(ctx, aliasToDelete)
 		if err != nil {
-			return false, err
+			return result, err
 		}
+		result.Deleted = append(result.Deleted, aliasToDelete.GetFQDN())
 	}
-	return true, nil
+	if len(plan.Create) == 0 {
+		return result, nil
+	}
+	for _, aliasToCreate := range plan.Create {
+		if _, _, ok := SplitFQDN(aliasToCreate, plan.Domains); !ok {
+			return result, fmt.Errorf("alias %v is not in one of the domains [%v]", aliasToCreate, strings.Join(plan.Domains, ", "))
+		}
+	}
+	records, err := c.getAddressRecords(ctx, plan.Host)
+	if err != nil {
+		return result, err
+	}
+	if len(records) == 0 {
+		return result, notFoundError{kind: "Host override", fqdn: plan.Host}
+	}
+	for _, aliasToCreate := range plan.Create {
+		hostname, domain, _ := SplitFQDN(aliasToCreate, plan.Domains)
+		for _, record := range records {
+			aliasOverride := NewAliasOverride(hostname, domain, record.UUID)
+			created, err := c.CreateAliasOverrideContext(ctx, aliasOverride)
+			if err != nil {
+				return result, err
+			}
+			if !created {
+				return result, fmt.Errorf("OPNsense did not create alias override %v", aliasToCreate)
+			}
+		}
+		result.Created = append(result.Created, aliasToCreate)
+	}
+	return result, nil
 }
 
-func (c *apiKeyClient) getAliasesToCreateAndDelete(currentAliases []string, existingAliases []AliasOverride) ([]string, []string) {
+func (c *apiKeyClient) getAliasesToCreateAndDelete(currentAliases []string, existingAliases []AliasOverride) ([]string, []AliasOverride) {
 	var aliasesToCreate []string
-	var aliasesToDelete []string
+	var aliasesToDelete []AliasOverride
 
 	// get current aliases to create
 	for _, currentAliasFQDN := range currentAliases {
@@ -246,14 +564,20 @@ func (c *apiKeyClient) getAliasesToCreateAndDelete(currentAliases []string, exis
 			}
 		}
 		if !shouldAliasExist {
-			aliasesToDelete = append(aliasesToDelete, existingAlias.GetFQDN())
+			aliasesToDelete = append(aliasesToDelete, existingAlias)
 		}
 	}
 	return aliasesToCreate, aliasesToDelete
 }
 
-func (c *apiKeyClient) Reconfigure() error {
+func (c *apiKeyClient) ReconfigureContext(ctx context.Context) error {
 	endpoint := fmt.Sprintf("%s/api/unbound/settings/reconfigure/", c.address)
-	_, err := c.newRequest().Post(endpoint)
-	return err
+	resp, err := c.newRequest(ctx).Post(endpoint)
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return newStatusError(resp)
+	}
+	return nil
 }
@@ -1,9 +1,9 @@
 package opnsense
 
 import (
+	"OPNsenseProxyAPI/opnsense/opnsensetest"
 	"crypto/tls"
 	"github.com/go-resty/resty/v2"
-	"os"
 	"reflect"
 	"testing"
 )
@@ -15,23 +15,40 @@ type apiClientFields struct {
 	client    *resty.Client
 }
 
-func generateAPIClientFields() apiClientFields {
-	apiKey := os.Getenv("API_KEY")
-	apiSecret := os.Getenv("API_SECRET")
-	address := os.Getenv("OPNSENSE_ADDRESS")
+// generateAPIClientFields starts a fake OPNsense with the overrides the tests expect and returns fields pointing to it.
+func generateAPIClientFields(t *testing.T) apiClientFields {
+	server := newTestServer(t)
 	client := resty.New()
 	client.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
 	return apiClientFields{
-		apiKey:    apiKey,
-		apiSecret: apiSecret,
-		address:   address,
+		apiKey:    server.APIKey,
+		apiSecret: server.APISecret,
+		address:   server.URL,
 		client:    client,
 	}
 }
 
+func newTestServer(t *testing.T) *opnsensetest.Server {
+	server := opnsensetest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddHostOverride(opnsensetest.HostOverride{UUID: "f2a5edee-1b46-4a08-9041-4f51e02932f5", Hostname: "test", Domain: "testdomain.com", Type: "A", Server: "10.0.1.0"})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "testDeleteHost", Domain: "testdomain.com", Type: "A", Server: "10.0.1.1"})
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "testUpdateHost", Domain: "testdomain.com", Type: "A", Server: "10.0.1.2"})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: "test.testdomain.com", Hostname: "testDelete", Domain: "testdomain.com"})
+	return server
+}
+
+func newTestClient(t *testing.T, server *opnsensetest.Server) *apiKeyClient {
+	client, err := NewClientWithTLS(server.URL, server.APIKey, server.APISecret, TLSOptions{PinnedSHA256: server.CertificateSHA256()})
+	if err != nil {
+		t.Fatalf("NewClientWithTLS() error = %v", err)
+	}
+	return client.(*apiKeyClient)
+}
+
 func Test_apiKeyClient_CreateAliasOverride(t *testing.T) {
 
-	fieldConst := generateAPIClientFields()
+	fieldConst := generateAPIClientFields(t)
 
 	type args struct {
 		aliasOverride AliasOverride
@@ -80,7 +97,7 @@ func Test_apiKeyClient_CreateAliasOverride(t *testing.T) {
 }
 
 func Test_apiKeyClient_CreateHostOverride(t *testing.T) {
-	fieldConst := generateAPIClientFields()
+	fieldConst := generateAPIClientFields(t)
 	type args struct {
 		hostOverride HostOverride
 	}
@@ -120,7 +137,7 @@ func Test_apiKeyClient_CreateHostOverride(t *testing.T) {
 }
 
 func Test_apiKeyClient_GetAliasOverrides(t *testing.T) {
-	fieldConsts := generateAPIClientFields()
+	fieldConsts := generateAPIClientFields(t)
 	tests := []struct {
 		name    string
 		fields  apiClientFields
@@ -150,7 +167,7 @@ func Test_apiKeyClient_GetAliasOverrides(t *testing.T) {
 }
 
 func Test_apiKeyClient_GetHostOverrides(t *testing.T) {
-	fieldConsts := generateAPIClientFields()
+	fieldConsts := generateAPIClientFields(t)
 	tests := []struct {
 		name    string
 		fields  apiClientFields
@@ -180,7 +197,7 @@ func Test_apiKeyClient_GetHostOverrides(t *testing.T) {
 }
 
 func Test_apiKeyClient_DeleteAliasOverride(t *testing.T) {
-	fieldConsts := generateAPIClientFields()
+	fieldConsts := generateAPIClientFields(t)
 	type args struct {
 		fqdn string
 	}
@@ -227,7 +244,7 @@ func Test_apiKeyClient_DeleteAliasOverride(t *testing.T) {
 }
 
 func Test_apiKeyClient_DeleteHostOverride(t *testing.T) {
-	fieldConsts := generateAPIClientFields()
+	fieldConsts := generateAPIClientFields(t)
 	type args struct {
 		fqdn string
 	}
@@ -274,7 +291,7 @@ func Test_apiKeyClient_DeleteHostOverride(t *testing.T) {
 }
 
 func Test_apiKeyClient_getAliasesToCreateAndDelete(t *testing.T) {
-	fieldConsts := generateAPIClientFields()
+	fieldConsts := generateAPIClientFields(t)
 	type args struct {
 		currentAliases  []string
 		existingAliases []AliasOverride
@@ -284,7 +301,7 @@ func Test_apiKeyClient_getAliasesToCreateAndDelete(t *testing.T) {
 		fields       apiClientFields
 		args         args
 		wantToCreate []string
-		wantToDelete []string
+		wantToDelete []AliasOverride
 	}{
 		{
 			name:   "Test Sync",
@@ -321,8 +338,11 @@ func Test_apiKeyClient_getAliasesToCreateAndDelete(t *testing.T) {
 			wantToCreate: []string{
 				"new.tld",
 			},
-			wantToDelete: []string{
-				"delete.tld",
+			wantToDelete: []AliasOverride{
+				{
+					Hostname: "delete",
+					Domain:   "tld",
+				},
 			},
 		},
 	}
@@ -344,3 +364,288 @@ func Test_apiKeyClient_getAliasesToCreateAndDelete(t *testing.T) {
 		})
 	}
 }
+
+func Test_apiKeyClient_UpdateHostOverride(t *testing.T) {
+	fieldConsts := generateAPIClientFields(t)
+	type args struct {
+		hostOverride HostOverride
+	}
+	tests := []struct {
+		name    string
+		fields  apiClientFields
+		args    args
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:    "Update host override without UUID",
+			fields:  fieldConsts,
+			args:    struct{ hostOverride HostOverride }{hostOverride: NewHostOverride("testUpdateHost", "testdomain.com", "10.0.2.1")},
+			want:    false,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &apiKeyClient{
+				apiKey:    tt.fields.apiKey,
+				apiSecret: tt.fields.apiSecret,
+				address:   tt.fields.address,
+				client:    tt.fields.client,
+			}
+			got, err := c.UpdateHostOverride(tt.args.hostOverride)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UpdateHostOverride() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("UpdateHostOverride() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_apiKeyClient_getAliasesToRecreate(t *testing.T) {
+	fieldConsts := generateAPIClientFields(t)
+	type args struct {
+		currentAliases  []string
+		existingAliases []AliasOverride
+		records         int
+	}
+	tests := []struct {
+		name   string
+		fields apiClientFields
+		args   args
+		want   map[string]bool
+	}{
+		{
+			name:   "Recreate aliases missing from the AAAA record",
+			fields: fieldConsts,
+			args: args{
+				currentAliases: []string{"1.tld", "2.tld", "new.tld"},
+				existingAliases: []AliasOverride{
+					{Hostname: "1", Domain: "tld"},
+					{Hostname: "1", Domain: "tld"},
+					{Hostname: "2", Domain: "tld"},
+				},
+				records: 2,
+			},
+			want: map[string]bool{"2.tld": true},
+		},
+		{
+			name:   "Recreate aliases of a deleted record",
+			fields: fieldConsts,
+			args: args{
+				currentAliases: []string{"1.tld"},
+				existingAliases: []AliasOverride{
+					{Hostname: "1", Domain: "tld"},
+					{Hostname: "1", Domain: "tld"},
+				},
+				records: 1,
+			},
+			want: map[string]bool{"1.tld": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &apiKeyClient{
+				apiKey:    tt.fields.apiKey,
+				apiSecret: tt.fields.apiSecret,
+				address:   tt.fields.address,
+				client:    tt.fields.client,
+			}
+			got := c.getAliasesToRecreate(tt.args.currentAliases, tt.args.existingAliases, tt.args.records)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getAliasesToRecreate() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHostOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		wantType string
+	}{
+		{name: "IPv4 address", server: "10.0.0.5", wantType: RecordTypeA},
+		{name: "IPv6 address", server: "fd00::5", wantType: RecordTypeAAAA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewHostOverride("host", "example.com", tt.server)
+			if got.Type != tt.wantType {
+				t.Errorf("NewHostOverride() type = %v, want %v", got.Type, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestSplitFQDN(t *testing.T) {
+	domains := []string{"example.com", "lab.example.com", "example.org."}
+	tests := []struct {
+		fqdn         string
+		wantHostname string
+		wantDomain   string
+		wantOK       bool
+	}{
+		{fqdn: "proxy1.example.com", wantHostname: "proxy1", wantDomain: "example.com", wantOK: true},
+		{fqdn: "proxy1.lab.example.com", wantHostname: "proxy1", wantDomain: "lab.example.com", wantOK: true},
+		{fqdn: "example.com.proxy1.example.com", wantHostname: "example.com.proxy1", wantDomain: "example.com", wantOK: true},
+		{fqdn: "Proxy1.Example.ORG.", wantHostname: "Proxy1", wantDomain: "example.org", wantOK: true},
+		{fqdn: "example.com", wantOK: false},
+		{fqdn: "proxy1.notexample.com", wantOK: false},
+		{fqdn: "proxy1.example.net", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fqdn, func(t *testing.T) {
+			hostname, domain, ok := SplitFQDN(tt.fqdn, domains)
+			if hostname != tt.wantHostname || domain != tt.wantDomain || ok != tt.wantOK {
+				t.Errorf("SplitFQDN() = %v, %v, %v, want %v, %v, %v", hostname, domain, ok, tt.wantHostname, tt.wantDomain, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_apiKeyClient_UpdateHostOverride_existing(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	hostOverride, err := c.GetHostOverride("testUpdateHost.testdomain.com")
+	if err != nil {
+		t.Fatalf("GetHostOverride() error = %v", err)
+	}
+	hostOverride.Server = "10.0.2.1"
+	got, err := c.UpdateHostOverride(hostOverride)
+	if err != nil || !got {
+		t.Fatalf("UpdateHostOverride() got = %v, error = %v", got, err)
+	}
+	updated, err := c.GetHostOverride("testUpdateHost.testdomain.com")
+	if err != nil {
+		t.Fatalf("GetHostOverride() error = %v", err)
+	}
+	if updated.Server != "10.0.2.1" || updated.RecordType() != RecordTypeA {
+		t.Errorf("GetHostOverride() got = %v, want server 10.0.2.1 of type A", updated)
+	}
+}
+
+func Test_apiKeyClient_SyncAliases(t *testing.T) {
+	server := newTestServer(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "test", Domain: "testdomain.com", Type: "AAAA", Server: "fd00::1"})
+	c := newTestClient(t, server)
+	got, err := c.SyncAliases("test.testdomain.com", []string{"testDelete.testdomain.com", "new.testdomain.com"}, "testdomain.com")
+	if err != nil {
+		t.Fatalf("SyncAliases() error = %v", err)
+	}
+	want := AliasSyncResult{Created: []string{"new.testdomain.com", "testDelete.testdomain.com"}, Deleted: []string{"testDelete.testdomain.com"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SyncAliases() got = %v, want %v", got, want)
+	}
+	// every alias must exist once for the A and once for the AAAA record
+	aliases := server.AliasOverrides()
+	if len(aliases) != 4 {
+		t.Errorf("SyncAliases() left %v alias overrides, want 4", len(aliases))
+	}
+	got, err = c.SyncAliases("test.testdomain.com", []string{"testDelete.testdomain.com", "new.testdomain.com"}, "testdomain.com")
+	if err != nil {
+		t.Fatalf("SyncAliases() error = %v", err)
+	}
+	if len(got.Created) != 0 || len(got.Deleted) != 0 {
+		t.Errorf("SyncAliases() of synced host got = %v, want no changes", got)
+	}
+}
+
+func Test_apiKeyClient_SyncAliasesInDomains(t *testing.T) {
+	server := newTestServer(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "testdomain.com", Type: "A", Server: "10.0.1.3"})
+	c := newTestClient(t, server)
+	got, err := c.SyncAliasesInDomains("proxy1.testdomain.com", []string{"app.lab.testdomain.com", "app.testdomain.org"}, []string{"testdomain.com", "lab.testdomain.com", "testdomain.org"})
+	if err != nil {
+		t.Fatalf("SyncAliasesInDomains() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Created, []string{"app.lab.testdomain.com", "app.testdomain.org"}) {
+		t.Errorf("SyncAliasesInDomains() got created = %v, want [app.lab.testdomain.com app.testdomain.org]", got.Created)
+	}
+	var domains []string
+	for _, alias := range server.AliasOverrides() {
+		if alias.Hostname == "app" {
+			domains = append(domains, alias.Domain)
+		}
+	}
+	if !reflect.DeepEqual(domains, []string{"lab.testdomain.com", "testdomain.org"}) {
+		t.Errorf("SyncAliasesInDomains() created aliases in domains %v, want [lab.testdomain.com testdomain.org]", domains)
+	}
+	_, err = c.SyncAliasesInDomains("proxy1.testdomain.com", []string{"app.testdomain.net"}, []string{"testdomain.com"})
+	if err == nil {
+		t.Errorf("SyncAliasesInDomains() of alias outside the domains got no error")
+	}
+}
+
+func Test_apiKeyClient_SyncAliases_sharedAlias(t *testing.T) {
+	server := newTestServer(t)
+	server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy1", Domain: "testdomain.com", Type: "A", Server: "10.0.1.3"})
+	proxy2 := server.AddHostOverride(opnsensetest.HostOverride{Hostname: "proxy2", Domain: "testdomain.com", Type: "A", Server: "10.0.1.4"})
+	// proxy2's alias is listed first, so deleting by FQDN would hit it instead of proxy1's
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: "proxy2.testdomain.com", Hostname: "shared", Domain: "testdomain.com"})
+	server.AddAliasOverride(opnsensetest.AliasOverride{Host: "proxy1.testdomain.com", Hostname: "shared", Domain: "testdomain.com"})
+	c := newTestClient(t, server)
+	plan, err := c.PlanAliases("proxy1.testdomain.com", []string{}, "testdomain.com", 1)
+	if err != nil {
+		t.Fatalf("PlanAliases() error = %v", err)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0].UUID == "" {
+		t.Fatalf("PlanAliases() got delete = %v, want the alias override of proxy1", plan.Delete)
+	}
+	got, err := c.ApplyAliasPlan(plan)
+	if err != nil {
+		t.Fatalf("ApplyAliasPlan() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Deleted, []string{"shared.testdomain.com"}) {
+		t.Errorf("ApplyAliasPlan() got deleted = %v, want [shared.testdomain.com]", got.Deleted)
+	}
+	var hosts []string
+	for _, alias := range server.AliasOverrides() {
+		if alias.Hostname == "shared" {
+			hosts = append(hosts, alias.Host)
+		}
+	}
+	if !reflect.DeepEqual(hosts, []string{proxy2}) {
+		t.Errorf("ApplyAliasPlan() left shared.testdomain.com on hosts %v, want proxy2 [%v]", hosts, proxy2)
+	}
+}
+
+func Test_apiKeyClient_faults(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(server *opnsensetest.Server)
+		wantErr bool
+	}{
+		{
+			name:    "Wrong credentials",
+			prepare: func(server *opnsensetest.Server) { server.APISecret = "other" },
+			wantErr: true,
+		},
+		{
+			name: "Server error",
+			prepare: func(server *opnsensetest.Server) {
+				server.InjectFault("searchHostOverride", opnsensetest.Fault{Status: 500, Count: 1})
+			},
+			wantErr: true,
+		},
+		{
+			name:    "No fault",
+			prepare: func(server *opnsensetest.Server) {},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			c := newTestClient(t, server)
+			tt.prepare(server)
+			_, err := c.GetHostOverrides()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetHostOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package opnsense
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reasons returned by FailureReason.
+const (
+	// FailureAuth means OPNsense rejected the API key and secret, or the key lacks the privileges for Unbound.
+	FailureAuth = "auth"
+	// FailureTLS means the certificate of OPNsense could not be verified, or the TLS handshake failed.
+	FailureTLS = "tls"
+	// FailureTimeout means OPNsense did not answer in time.
+	FailureTimeout = "timeout"
+	// FailureNetwork means OPNsense could not be reached, e.g. because of a DNS error or a refused connection.
+	FailureNetwork = "network"
+	// FailureAPI means OPNsense answered, but with an error.
+	FailureAPI = "api"
+)
+
+// FailureReason classifies an error returned by a Client, so that operators can tell
+// wrong credentials from certificate and network problems.
+func FailureReason(err error) string {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		if statusError.StatusCode == http.StatusUnauthorized || statusError.StatusCode == http.StatusForbidden {
+			return FailureAuth
+		}
+		return FailureAPI
+	}
+	if isTLSError(err) {
+		return FailureTLS
+	}
+	var netError net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netError) && netError.Timeout()) {
+		return FailureTimeout
+	}
+	if netError != nil {
+		return FailureNetwork
+	}
+	return FailureAPI
+}
+
+func isTLSError(err error) bool {
+	var verificationError *tls.CertificateVerificationError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var certificateInvalidError x509.CertificateInvalidError
+	var hostnameError x509.HostnameError
+	var recordHeaderError tls.RecordHeaderError
+	return errors.Is(err, ErrFingerprintMismatch) ||
+		errors.As(err, &verificationError) ||
+		errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &certificateInvalidError) ||
+		errors.As(err, &hostnameError) ||
+		errors.As(err, &recordHeaderError) ||
+		// alerts sent by OPNsense, e.g. for a rejected client certificate, have no exported type
+		strings.Contains(err.Error(), "remote error: tls:")
+}
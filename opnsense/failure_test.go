@@ -0,0 +1,92 @@
+package opnsense
+
+import (
+	"OPNsenseProxyAPI/opnsense/opnsensetest"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFailureReason(t *testing.T) {
+	otherFingerprint := sha256.Sum256([]byte("other certificate"))
+	tests := []struct {
+		name    string
+		prepare func(server *opnsensetest.Server) TLSOptions
+		timeout time.Duration
+		want    string
+	}{
+		{
+			name: "Wrong credentials",
+			prepare: func(server *opnsensetest.Server) TLSOptions {
+				server.APISecret = "other"
+				return TLSOptions{PinnedSHA256: server.CertificateSHA256()}
+			},
+			want: FailureAuth,
+		},
+		{
+			name: "Untrusted certificate",
+			prepare: func(server *opnsensetest.Server) TLSOptions {
+				return TLSOptions{}
+			},
+			want: FailureTLS,
+		},
+		{
+			name: "Other pinned certificate",
+			prepare: func(server *opnsensetest.Server) TLSOptions {
+				return TLSOptions{PinnedSHA256: hex.EncodeToString(otherFingerprint[:])}
+			},
+			want: FailureTLS,
+		},
+		{
+			name: "Slow OPNsense",
+			prepare: func(server *opnsensetest.Server) TLSOptions {
+				server.InjectFault("searchHostOverride", opnsensetest.Fault{Delay: time.Second})
+				return TLSOptions{PinnedSHA256: server.CertificateSHA256()}
+			},
+			timeout: 100 * time.Millisecond,
+			want:    FailureTimeout,
+		},
+		{
+			name: "Unreachable OPNsense",
+			prepare: func(server *opnsensetest.Server) TLSOptions {
+				server.Close()
+				return TLSOptions{PinnedSHA256: server.CertificateSHA256()}
+			},
+			want: FailureNetwork,
+		},
+		{
+			name: "Server error",
+			prepare: func(server *opnsensetest.Server) TLSOptions {
+				server.InjectFault("searchHostOverride", opnsensetest.Fault{Status: http.StatusInternalServerError})
+				return TLSOptions{PinnedSHA256: server.CertificateSHA256()}
+			},
+			want: FailureAPI,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			options := tt.prepare(server)
+			client, err := NewClientWithTLS(server.URL, "key", "secret", options)
+			if err != nil {
+				t.Fatalf("NewClientWithTLS() error = %v", err)
+			}
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			_, err = client.GetHostOverridesContext(ctx)
+			if err == nil {
+				t.Fatalf("GetHostOverridesContext() error = nil")
+			}
+			if got := FailureReason(err); got != tt.want {
+				t.Errorf("FailureReason(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
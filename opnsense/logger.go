@@ -0,0 +1,21 @@
+package opnsense
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+)
+
+type loggerContextKey struct{}
+
+// WithLogger returns a copy of ctx whose Client calls log to logger, e.g. to add the request ID of the caller to every line.
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// Logger returns the logger attached to ctx by WithLogger, or the standard logger.
+func Logger(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
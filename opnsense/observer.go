@@ -0,0 +1,70 @@
+package opnsense
+
+import (
+	"errors"
+	"github.com/go-resty/resty/v2"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Observer is told about every request the client sends to OPNsense and about the overrides returned by searches,
+// e.g. to export metrics.
+type Observer interface {
+	// ObserveRequest is called after each request with the API call (e.g. "searchHostOverride"),
+	// the HTTP status, or 0 when no response was received, and the error of the request.
+	ObserveRequest(endpoint string, status int, duration time.Duration, err error)
+	ObserveHostOverrides(hostOverrides []HostOverride)
+	ObserveAliasOverrides(aliasOverrides []AliasOverride)
+}
+
+// NewObservedClientWithTLS creates a Client like NewClientWithTLS that reports to observer.
+func NewObservedClientWithTLS(address, apiKey, apiSecret string, options TLSOptions, observer Observer) (Client, error) {
+	client, err := NewClientWithTLS(address, apiKey, apiSecret, options)
+	if err != nil {
+		return nil, err
+	}
+	c := client.(*apiKeyClient)
+	c.observer = observer
+	c.client.OnAfterResponse(func(_ *resty.Client, response *resty.Response) error {
+		observer.ObserveRequest(endpointName(response.Request.URL), response.StatusCode(), response.Time(), nil)
+		return nil
+	})
+	c.client.OnError(func(request *resty.Request, err error) {
+		status := 0
+		var responseError *resty.ResponseError
+		if errors.As(err, &responseError) {
+			status = responseError.Response.StatusCode()
+		}
+		var duration time.Duration
+		if !request.Time.IsZero() {
+			duration = time.Since(request.Time)
+		}
+		observer.ObserveRequest(endpointName(request.URL), status, duration, err)
+	})
+	return c, nil
+}
+
+// endpointName returns the API call of rawURL without the IDs in its path,
+// e.g. "delHostOverride" for https://opnsense/api/unbound/settings/delHostOverride/<uuid>.
+func endpointName(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "unknown"
+	}
+	_, call, found := strings.Cut(parsed.Path, "/api/")
+	if !found {
+		return "unknown"
+	}
+	name := "unknown"
+	for _, segment := range strings.Split(call, "/") {
+		if segment != "" && !isUUID(segment) {
+			name = segment
+		}
+	}
+	return name
+}
+
+func isUUID(value string) bool {
+	return len(value) == 36 && strings.Count(value, "-") == 4
+}
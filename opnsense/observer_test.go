@@ -0,0 +1,84 @@
+package opnsense
+
+import (
+	"OPNsenseProxyAPI/opnsense/opnsensetest"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type observedRequest struct {
+	endpoint string
+	status   int
+	err      bool
+}
+
+type recordingObserver struct {
+	mu            sync.Mutex
+	requests      []observedRequest
+	hostOverrides int
+	aliases       int
+}
+
+func (o *recordingObserver) ObserveRequest(endpoint string, status int, duration time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, observedRequest{endpoint: endpoint, status: status, err: err != nil})
+}
+
+func (o *recordingObserver) ObserveHostOverrides(hostOverrides []HostOverride) {
+	o.hostOverrides = len(hostOverrides)
+}
+
+func (o *recordingObserver) ObserveAliasOverrides(aliasOverrides []AliasOverride) {
+	o.aliases = len(aliasOverrides)
+}
+
+func Test_endpointName(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{rawURL: "https://opnsense/api/unbound/settings/searchHostOverride/", want: "searchHostOverride"},
+		{rawURL: "https://opnsense/api/unbound/settings/delHostOverride/f2a5edee-1b46-4a08-9041-4f51e02932f5", want: "delHostOverride"},
+		{rawURL: "https://opnsense:8443/base/api/unbound/settings/addHostAlias", want: "addHostAlias"},
+		{rawURL: "https://opnsense/other", want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawURL, func(t *testing.T) {
+			if got := endpointName(tt.rawURL); got != tt.want {
+				t.Errorf("endpointName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewObservedClientWithTLS(t *testing.T) {
+	server := newTestServer(t)
+	observer := &recordingObserver{}
+	client, err := NewObservedClientWithTLS(server.URL, server.APIKey, server.APISecret, TLSOptions{PinnedSHA256: server.CertificateSHA256()}, observer)
+	if err != nil {
+		t.Fatalf("NewObservedClientWithTLS() error = %v", err)
+	}
+	_, _ = client.GetHostOverrides()
+	_, _ = client.GetAliasOverrides()
+	server.InjectFault("reconfigure", opnsensetest.Fault{Status: http.StatusInternalServerError, Count: 1})
+	_ = client.Reconfigure()
+	server.Close()
+	_, _ = client.DeleteHostOverrideRecord(HostOverride{UUID: "f2a5edee-1b46-4a08-9041-4f51e02932f5"})
+
+	want := []observedRequest{
+		{endpoint: "searchHostOverride", status: http.StatusOK},
+		{endpoint: "searchHostAlias", status: http.StatusOK},
+		{endpoint: "reconfigure", status: http.StatusInternalServerError},
+		{endpoint: "delHostOverride", status: 0, err: true},
+	}
+	if !reflect.DeepEqual(observer.requests, want) {
+		t.Errorf("observed requests = %+v, want %+v", observer.requests, want)
+	}
+	if observer.hostOverrides != 3 || observer.aliases != 1 {
+		t.Errorf("observed %v host overrides and %v aliases, want 3 and 1", observer.hostOverrides, observer.aliases)
+	}
+}
@@ -0,0 +1,483 @@
+// Package opnsensetest provides an in-memory stand-in for the Unbound API of OPNsense,
+// so that code using the opnsense package can be tested without a firewall.
+package opnsensetest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const settingsPath = "/api/unbound/settings/"
+
+// HostOverride is a host override as stored by the server. Type is the plain record type, e.g. "A".
+type HostOverride struct {
+	UUID        string
+	Enabled     string
+	Hostname    string
+	Domain      string
+	Type        string
+	Server      string
+	Description string
+}
+
+func (hostOverride HostOverride) FQDN() string {
+	return fmt.Sprintf("%s.%s", hostOverride.Hostname, hostOverride.Domain)
+}
+
+// AliasOverride is an alias override as stored by the server. Host is the UUID of its host override.
+type AliasOverride struct {
+	UUID        string
+	Enabled     string
+	Host        string
+	Hostname    string
+	Domain      string
+	Description string
+}
+
+func (aliasOverride AliasOverride) FQDN() string {
+	return fmt.Sprintf("%s.%s", aliasOverride.Hostname, aliasOverride.Domain)
+}
+
+// Fault makes the server fail requests to an endpoint.
+type Fault struct {
+	// Status is returned instead of handling the request. Zero handles the request after Delay.
+	Status int
+	// Delay is waited before answering, or until the request is canceled.
+	Delay time.Duration
+	// Count is the number of requests the fault applies to. Zero applies it until ClearFaults is called.
+	Count int
+}
+
+// Server serves the Unbound endpoints used by the opnsense package over TLS.
+// Requests must authenticate with APIKey and APISecret using basic auth.
+type Server struct {
+	URL       string
+	APIKey    string
+	APISecret string
+
+	server       *httptest.Server
+	mu           sync.Mutex
+	hosts        []HostOverride
+	aliases      []AliasOverride
+	faults       map[string]*Fault
+	calls        map[string]int
+	reconfigures int
+}
+
+// NewServer starts a Server without any overrides. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		APIKey:    "key",
+		APISecret: "secret",
+		faults:    make(map[string]*Fault),
+		calls:     make(map[string]int),
+	}
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// CertificateSHA256 returns the hex encoded SHA-256 fingerprint of the server's self-signed certificate.
+func (s *Server) CertificateSHA256() string {
+	fingerprint := sha256.Sum256(s.server.Certificate().Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// AddHostOverride stores hostOverride and returns its UUID, which is generated when empty.
+func (s *Server) AddHostOverride(hostOverride HostOverride) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hostOverride.UUID == "" {
+		hostOverride.UUID = newUUID()
+	}
+	if hostOverride.Enabled == "" {
+		hostOverride.Enabled = "1"
+	}
+	s.hosts = append(s.hosts, hostOverride)
+	return hostOverride.UUID
+}
+
+// AddAliasOverride stores aliasOverride and returns its UUID, which is generated when empty.
+// Host may be the UUID or the FQDN of an existing host override.
+func (s *Server) AddAliasOverride(aliasOverride AliasOverride) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range s.hosts {
+		if host.FQDN() == aliasOverride.Host {
+			aliasOverride.Host = host.UUID
+			break
+		}
+	}
+	if aliasOverride.UUID == "" {
+		aliasOverride.UUID = newUUID()
+	}
+	if aliasOverride.Enabled == "" {
+		aliasOverride.Enabled = "1"
+	}
+	s.aliases = append(s.aliases, aliasOverride)
+	return aliasOverride.UUID
+}
+
+// HostOverrides returns a copy of the stored host overrides.
+func (s *Server) HostOverrides() []HostOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HostOverride(nil), s.hosts...)
+}
+
+// AliasOverrides returns a copy of the stored alias overrides.
+func (s *Server) AliasOverrides() []AliasOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AliasOverride(nil), s.aliases...)
+}
+
+// Reconfigures returns how often Unbound was reconfigured.
+func (s *Server) Reconfigures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reconfigures
+}
+
+// Calls returns how often endpoint (e.g. "searchHostOverride") was requested, including failed requests.
+func (s *Server) Calls(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[strings.ToLower(endpoint)]
+}
+
+// InjectFault makes requests to endpoint (e.g. "addHostAlias") fail as described by fault.
+func (s *Server) InjectFault(endpoint string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[strings.ToLower(endpoint)] = &fault
+}
+
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = make(map[string]*Fault)
+}
+
+type hostOverrideRow struct {
+	UUID        string `json:"uuid"`
+	Enabled     string `json:"enabled"`
+	Hostname    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Type        string `json:"rr"`
+	Server      string `json:"server"`
+	Description string `json:"description"`
+}
+
+type aliasOverrideRow struct {
+	UUID        string `json:"uuid"`
+	Enabled     string `json:"enabled"`
+	Host        string `json:"host"`
+	Hostname    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Description string `json:"description"`
+}
+
+type searchResponse struct {
+	Rows     any `json:"rows"`
+	RowCount int `json:"rowCount"`
+	Total    int `json:"total"`
+	Current  int `json:"current"`
+}
+
+type mutationResponse struct {
+	Result      string            `json:"result"`
+	UUID        string            `json:"uuid,omitempty"`
+	Validations map[string]string `json:"validations,omitempty"`
+}
+
+// recordTypeDescriptions mirrors how OPNsense displays record types in search results.
+var recordTypeDescriptions = map[string]string{
+	"A":    "A (IPv4 address)",
+	"AAAA": "AAAA (IPv6 address)",
+	"MX":   "MX (Mail server)",
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, settingsPath) {
+		http.NotFound(w, r)
+		return
+	}
+	endpoint, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, settingsPath), "/")
+	endpoint = strings.ToLower(endpoint)
+	key, secret, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(s.APIKey)) != 1 || subtle.ConstantTimeCompare([]byte(secret), []byte(s.APISecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "401", "message": "Authentication Failed"})
+		return
+	}
+	if fault := s.takeFault(endpoint); fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.Status != 0 {
+			writeJSON(w, fault.Status, map[string]string{"message": "injected fault"})
+			return
+		}
+	}
+	switch {
+	case endpoint == "searchhostoverride":
+		s.searchHostOverride(w)
+	case endpoint == "searchhostalias":
+		s.searchHostAlias(w)
+	case endpoint == "addhostoverride" && r.Method == http.MethodPost:
+		s.saveHostOverride(w, r, "")
+	case endpoint == "sethostoverride" && r.Method == http.MethodPost:
+		s.saveHostOverride(w, r, id)
+	case endpoint == "addhostalias" && r.Method == http.MethodPost:
+		s.addHostAlias(w, r)
+	case endpoint == "delhostoverride" && r.Method == http.MethodPost:
+		s.delHostOverride(w, id)
+	case endpoint == "delhostalias" && r.Method == http.MethodPost:
+		s.delHostAlias(w, id)
+	case endpoint == "reconfigure" && r.Method == http.MethodPost:
+		s.reconfigure(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) takeFault(endpoint string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[endpoint]++
+	fault, ok := s.faults[endpoint]
+	if !ok {
+		return nil
+	}
+	if fault.Count > 0 {
+		fault.Count--
+		if fault.Count == 0 {
+			delete(s.faults, endpoint)
+		}
+	}
+	return fault
+}
+
+func (s *Server) searchHostOverride(w http.ResponseWriter) {
+	s.mu.Lock()
+	rows := []hostOverrideRow{}
+	for _, host := range s.hosts {
+		recordType := host.Type
+		if description, ok := recordTypeDescriptions[recordType]; ok {
+			recordType = description
+		}
+		rows = append(rows, hostOverrideRow{
+			UUID:        host.UUID,
+			Enabled:     host.Enabled,
+			Hostname:    host.Hostname,
+			Domain:      host.Domain,
+			Type:        recordType,
+			Server:      host.Server,
+			Description: host.Description,
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, searchResponse{Rows: rows, RowCount: len(rows), Total: len(rows), Current: 1})
+}
+
+func (s *Server) searchHostAlias(w http.ResponseWriter) {
+	s.mu.Lock()
+	rows := []aliasOverrideRow{}
+	for _, alias := range s.aliases {
+		// like OPNsense, the host is displayed as the FQDN of the referenced host override
+		host := ""
+		for _, hostOverride := range s.hosts {
+			if hostOverride.UUID == alias.Host {
+				host = hostOverride.FQDN()
+			}
+		}
+		rows = append(rows, aliasOverrideRow{
+			UUID:        alias.UUID,
+			Enabled:     alias.Enabled,
+			Host:        host,
+			Hostname:    alias.Hostname,
+			Domain:      alias.Domain,
+			Description: alias.Description,
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, searchResponse{Rows: rows, RowCount: len(rows), Total: len(rows), Current: 1})
+}
+
+// saveHostOverride adds a host override, or replaces the one identified by uuid.
+func (s *Server) saveHostOverride(w http.ResponseWriter, r *http.Request, uuid string) {
+	var container struct {
+		Host hostOverrideRow `json:"host"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&container); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	row := container.Host
+	validations := validateHostOverride(row)
+	if len(validations) > 0 {
+		writeJSON(w, http.StatusOK, mutationResponse{Result: "failed", Validations: validations})
+		return
+	}
+	hostOverride := HostOverride{
+		UUID:        uuid,
+		Enabled:     row.Enabled,
+		Hostname:    row.Hostname,
+		Domain:      row.Domain,
+		Type:        row.Type,
+		Server:      row.Server,
+		Description: row.Description,
+	}
+	if hostOverride.Enabled == "" {
+		hostOverride.Enabled = "1"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uuid == "" {
+		hostOverride.UUID = newUUID()
+		s.hosts = append(s.hosts, hostOverride)
+		writeJSON(w, http.StatusOK, mutationResponse{Result: "saved", UUID: hostOverride.UUID})
+		return
+	}
+	for i := range s.hosts {
+		if s.hosts[i].UUID == uuid {
+			s.hosts[i] = hostOverride
+			writeJSON(w, http.StatusOK, mutationResponse{Result: "saved"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, mutationResponse{Result: "failed"})
+}
+
+func validateHostOverride(row hostOverrideRow) map[string]string {
+	validations := make(map[string]string)
+	if row.Hostname == "" {
+		validations["host.hostname"] = "A hostname must be specified."
+	}
+	if row.Domain == "" {
+		validations["host.domain"] = "A domain must be specified."
+	}
+	ip := net.ParseIP(row.Server)
+	switch row.Type {
+	case "A":
+		if ip == nil || ip.To4() == nil {
+			validations["host.server"] = "A valid IPv4 address must be specified."
+		}
+	case "AAAA":
+		if ip == nil || ip.To4() != nil {
+			validations["host.server"] = "A valid IPv6 address must be specified."
+		}
+	case "MX":
+	default:
+		validations["host.rr"] = "Option not in list."
+	}
+	return validations
+}
+
+func (s *Server) addHostAlias(w http.ResponseWriter, r *http.Request) {
+	var container struct {
+		Alias aliasOverrideRow `json:"alias"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&container); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	row := container.Alias
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	validations := make(map[string]string)
+	hostExists := false
+	for _, host := range s.hosts {
+		if host.UUID == row.Host {
+			hostExists = true
+		}
+	}
+	if !hostExists {
+		validations["alias.host"] = "Related item not found"
+	}
+	if row.Domain == "" {
+		validations["alias.domain"] = "A domain must be specified."
+	}
+	if len(validations) > 0 {
+		writeJSON(w, http.StatusOK, mutationResponse{Result: "failed", Validations: validations})
+		return
+	}
+	alias := AliasOverride{
+		UUID:        newUUID(),
+		Enabled:     row.Enabled,
+		Host:        row.Host,
+		Hostname:    row.Hostname,
+		Domain:      row.Domain,
+		Description: row.Description,
+	}
+	if alias.Enabled == "" {
+		alias.Enabled = "1"
+	}
+	s.aliases = append(s.aliases, alias)
+	writeJSON(w, http.StatusOK, mutationResponse{Result: "saved", UUID: alias.UUID})
+}
+
+func (s *Server) delHostOverride(w http.ResponseWriter, uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, host := range s.hosts {
+		if host.UUID == uuid {
+			s.hosts = append(s.hosts[:i], s.hosts[i+1:]...)
+			writeJSON(w, http.StatusOK, mutationResponse{Result: "deleted"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, mutationResponse{Result: "not found"})
+}
+
+func (s *Server) delHostAlias(w http.ResponseWriter, uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, alias := range s.aliases {
+		if alias.UUID == uuid {
+			s.aliases = append(s.aliases[:i], s.aliases[i+1:]...)
+			writeJSON(w, http.StatusOK, mutationResponse{Result: "deleted"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, mutationResponse{Result: "not found"})
+}
+
+func (s *Server) reconfigure(w http.ResponseWriter) {
+	s.mu.Lock()
+	s.reconfigures++
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,251 @@
+package opnsense
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// ReconfigureScheduler coalesces reconfigurations of Unbound. Every restart of Unbound drops queries,
+// so instead of reconfiguring after each change, changes mark Unbound dirty and a single reconfiguration
+// is issued once no change happened for the quiet period, or at the latest max delay after the first change.
+type ReconfigureScheduler struct {
+	client      Client
+	quietPeriod time.Duration
+	maxDelay    time.Duration
+	timeout     time.Duration
+	// retryDelay is waited before retrying a failed reconfiguration
+	retryDelay time.Duration
+
+	// flushMu serializes flushes, mu guards the fields below
+	flushMu    sync.Mutex
+	mu         sync.Mutex
+	dirty      bool
+	dirtySince time.Time
+	timer      *time.Timer
+	// waiters are served by the next flush, flushing by the flush in progress
+	waiters  []chan error
+	flushing *[]chan error
+}
+
+// NewReconfigureScheduler creates a scheduler that reconfigures Unbound through client.
+func NewReconfigureScheduler(client Client, quietPeriod, maxDelay time.Duration) *ReconfigureScheduler {
+	if maxDelay < quietPeriod {
+		maxDelay = quietPeriod
+	}
+	return &ReconfigureScheduler{
+		client:      client,
+		quietPeriod: quietPeriod,
+		maxDelay:    maxDelay,
+		timeout:     60 * time.Second,
+		retryDelay:  10 * time.Second,
+	}
+}
+
+// MarkDirty schedules a reconfiguration after the quiet period, but no later than max delay after the first unflushed change.
+func (s *ReconfigureScheduler) MarkDirty() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if !s.dirty {
+		s.dirty = true
+		s.dirtySince = now
+	}
+	delay := s.quietPeriod
+	if deadline := s.dirtySince.Add(s.maxDelay); now.Add(delay).After(deadline) {
+		delay = deadline.Sub(now)
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(delay, func() {
+		_ = s.Flush(context.Background())
+	})
+}
+
+// Wait blocks until the changes marked so far are applied by a reconfiguration and returns its error.
+// It returns immediately when nothing is pending.
+func (s *ReconfigureScheduler) Wait(ctx context.Context) error {
+	done := make(chan error, 1)
+	s.mu.Lock()
+	switch {
+	case s.dirty:
+		s.waiters = append(s.waiters, done)
+	case s.flushing != nil:
+		*s.flushing = append(*s.flushing, done)
+	default:
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush reconfigures Unbound now if changes are pending. When the reconfiguration fails, the changes stay pending
+// and are retried after the retry delay, unless a later change already scheduled a reconfiguration.
+func (s *ReconfigureScheduler) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.dirty = false
+	waiters := s.waiters
+	s.waiters = nil
+	s.flushing = &waiters
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	err := s.client.ReconfigureContext(ctx)
+	cancel()
+	if err != nil {
+		log.Errorf("Error while reconfiguring Unbound, retrying in %v: %v", s.retryDelay, err)
+	}
+
+	s.mu.Lock()
+	waiters = *s.flushing
+	s.flushing = nil
+	if err != nil {
+		if !s.dirty {
+			s.dirty = true
+			s.dirtySince = time.Now()
+		}
+		if s.timer == nil {
+			s.timer = time.AfterFunc(s.retryDelay, func() {
+				_ = s.Flush(context.Background())
+			})
+		}
+	}
+	s.mu.Unlock()
+	for _, waiter := range waiters {
+		waiter <- err
+	}
+	return err
+}
+
+// Client returns a Client whose mutations mark Unbound dirty and whose Reconfigure only schedules a reconfiguration.
+func (s *ReconfigureScheduler) Client() Client {
+	return &scheduledClient{Client: s.client, scheduler: s}
+}
+
+// scheduledClient marks the scheduler dirty after every call that may have changed an override.
+type scheduledClient struct {
+	Client
+	scheduler *ReconfigureScheduler
+}
+
+func (c *scheduledClient) CreateHostOverride(hostOverride HostOverride) (bool, error) {
+	return c.CreateHostOverrideContext(context.Background(), hostOverride)
+}
+
+func (c *scheduledClient) CreateHostOverrideContext(ctx context.Context, hostOverride HostOverride) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.CreateHostOverrideContext(ctx, hostOverride)
+}
+
+func (c *scheduledClient) CreateAliasOverride(aliasOverride AliasOverride) (bool, error) {
+	return c.CreateAliasOverrideContext(context.Background(), aliasOverride)
+}
+
+func (c *scheduledClient) CreateAliasOverrideContext(ctx context.Context, aliasOverride AliasOverride) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.CreateAliasOverrideContext(ctx, aliasOverride)
+}
+
+func (c *scheduledClient) UpdateHostOverride(hostOverride HostOverride) (bool, error) {
+	return c.UpdateHostOverrideContext(context.Background(), hostOverride)
+}
+
+func (c *scheduledClient) UpdateHostOverrideContext(ctx context.Context, hostOverride HostOverride) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.UpdateHostOverrideContext(ctx, hostOverride)
+}
+
+func (c *scheduledClient) DeleteHostOverride(fqdn string) (bool, error) {
+	return c.DeleteHostOverrideContext(context.Background(), fqdn)
+}
+
+func (c *scheduledClient) DeleteHostOverrideContext(ctx context.Context, fqdn string) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.DeleteHostOverrideContext(ctx, fqdn)
+}
+
+func (c *scheduledClient) DeleteHostOverrideRecord(hostOverride HostOverride) (bool, error) {
+	return c.DeleteHostOverrideRecordContext(context.Background(), hostOverride)
+}
+
+func (c *scheduledClient) DeleteHostOverrideRecordContext(ctx context.Context, hostOverride HostOverride) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.DeleteHostOverrideRecordContext(ctx, hostOverride)
+}
+
+func (c *scheduledClient) DeleteAliasOverride(fqdn string) (bool, error) {
+	return c.DeleteAliasOverrideContext(context.Background(), fqdn)
+}
+
+func (c *scheduledClient) DeleteAliasOverrideContext(ctx context.Context, fqdn string) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.DeleteAliasOverrideContext(ctx, fqdn)
+}
+
+func (c *scheduledClient) DeleteAliasOverrideRecord(aliasOverride AliasOverride) (bool, error) {
+	return c.DeleteAliasOverrideRecordContext(context.Background(), aliasOverride)
+}
+
+func (c *scheduledClient) DeleteAliasOverrideRecordContext(ctx context.Context, aliasOverride AliasOverride) (bool, error) {
+	defer c.scheduler.MarkDirty()
+	return c.Client.DeleteAliasOverrideRecordContext(ctx, aliasOverride)
+}
+
+func (c *scheduledClient) ApplyAliasPlan(plan AliasPlan) (AliasSyncResult, error) {
+	return c.ApplyAliasPlanContext(context.Background(), plan)
+}
+
+func (c *scheduledClient) ApplyAliasPlanContext(ctx context.Context, plan AliasPlan) (AliasSyncResult, error) {
+	if !plan.IsEmpty() {
+		defer c.scheduler.MarkDirty()
+	}
+	return c.Client.ApplyAliasPlanContext(ctx, plan)
+}
+
+func (c *scheduledClient) SyncAliases(host string, aliases []string, domain string) (AliasSyncResult, error) {
+	return c.SyncAliasesContext(context.Background(), host, aliases, domain)
+}
+
+func (c *scheduledClient) SyncAliasesContext(ctx context.Context, host string, aliases []string, domain string) (AliasSyncResult, error) {
+	return c.SyncAliasesInDomainsContext(ctx, host, aliases, []string{domain})
+}
+
+func (c *scheduledClient) SyncAliasesInDomains(host string, aliases []string, domains []string) (AliasSyncResult, error) {
+	return c.SyncAliasesInDomainsContext(context.Background(), host, aliases, domains)
+}
+
+func (c *scheduledClient) SyncAliasesInDomainsContext(ctx context.Context, host string, aliases []string, domains []string) (AliasSyncResult, error) {
+	result, err := c.Client.SyncAliasesInDomainsContext(ctx, host, aliases, domains)
+	if err != nil || len(result.Created) > 0 || len(result.Deleted) > 0 {
+		c.scheduler.MarkDirty()
+	}
+	return result, err
+}
+
+func (c *scheduledClient) Reconfigure() error {
+	return c.ReconfigureContext(context.Background())
+}
+
+// ReconfigureContext schedules a reconfiguration instead of reconfiguring right away.
+func (c *scheduledClient) ReconfigureContext(ctx context.Context) error {
+	c.scheduler.MarkDirty()
+	return nil
+}
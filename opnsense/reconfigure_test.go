@@ -0,0 +1,125 @@
+package opnsense
+
+import (
+	"OPNsenseProxyAPI/opnsense/opnsensetest"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReconfigureScheduler(t *testing.T) {
+	tests := []struct {
+		name        string
+		quietPeriod time.Duration
+		maxDelay    time.Duration
+		changes     int
+		interval    time.Duration
+		// fault fails the first reconfiguration, which must be retried
+		fault   bool
+		wantMin int
+		wantMax int
+	}{
+		{
+			name:        "Coalesce changes within the quiet period",
+			quietPeriod: 100 * time.Millisecond,
+			maxDelay:    time.Second,
+			changes:     5,
+			interval:    10 * time.Millisecond,
+			wantMin:     1,
+			wantMax:     1,
+		},
+		{
+			name:        "Flush after max delay while changes keep coming",
+			quietPeriod: 100 * time.Millisecond,
+			maxDelay:    150 * time.Millisecond,
+			changes:     10,
+			interval:    50 * time.Millisecond,
+			wantMin:     2,
+			wantMax:     9,
+		},
+		{
+			name:        "Retry failed reconfiguration",
+			quietPeriod: 10 * time.Millisecond,
+			maxDelay:    10 * time.Millisecond,
+			fault:       true,
+			changes:     1,
+			wantMin:     1,
+			wantMax:     1,
+		},
+		{
+			name:        "Nothing to flush",
+			quietPeriod: 10 * time.Millisecond,
+			maxDelay:    10 * time.Millisecond,
+			changes:     0,
+			wantMin:     0,
+			wantMax:     0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			scheduler := NewReconfigureScheduler(newTestClient(t, server), tt.quietPeriod, tt.maxDelay)
+			scheduler.retryDelay = 10 * time.Millisecond
+			if tt.fault {
+				server.InjectFault("reconfigure", opnsensetest.Fault{Status: http.StatusInternalServerError, Count: 1})
+			}
+			client := scheduler.Client()
+			for i := 0; i < tt.changes; i++ {
+				_, err := client.CreateAliasOverride(AliasOverride{Host: "f2a5edee-1b46-4a08-9041-4f51e02932f5", Hostname: "alias", Domain: "testdomain.com"})
+				if err != nil {
+					t.Fatalf("CreateAliasOverride() error = %v", err)
+				}
+				err = client.Reconfigure()
+				if err != nil {
+					t.Fatalf("Reconfigure() error = %v", err)
+				}
+				time.Sleep(tt.interval)
+			}
+			err := scheduler.Wait(context.Background())
+			if tt.fault {
+				if err == nil {
+					t.Fatalf("Wait() for failed reconfiguration error = nil, want error")
+				}
+				err = scheduler.Wait(context.Background())
+			}
+			if err != nil {
+				t.Fatalf("Wait() error = %v", err)
+			}
+			if got := server.Reconfigures(); got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("Reconfigures() got = %v, want between %v and %v", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestReconfigureScheduler_Wait(t *testing.T) {
+	server := newTestServer(t)
+	scheduler := NewReconfigureScheduler(newTestClient(t, server), time.Hour, time.Hour)
+	scheduler.MarkDirty()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := scheduler.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() before the flush error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	server.InjectFault("reconfigure", opnsensetest.Fault{Status: http.StatusInternalServerError, Count: 1})
+	scheduler.retryDelay = 10 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- scheduler.Wait(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := scheduler.Flush(context.Background()); err == nil {
+		t.Errorf("Flush() with failing OPNsense error = nil, want error")
+	}
+	if err := <-done; err == nil {
+		t.Errorf("Wait() for failed flush error = nil, want error")
+	}
+	// the failed changes are retried, so this waits for the retry instead of returning immediately
+	if err := scheduler.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() for retry error = %v, want nil", err)
+	}
+	if err := scheduler.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() without changes error = %v, want nil", err)
+	}
+}
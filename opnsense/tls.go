@@ -0,0 +1,104 @@
+package opnsense
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+// ErrFingerprintMismatch is matched by errors.Is when OPNsense presents a certificate other than the pinned one.
+var ErrFingerprintMismatch = errors.New("certificate fingerprint does not match pinned fingerprint")
+
+// TLSOptions configures how the client verifies the certificate of OPNsense.
+// Without options, the certificate must be signed by a CA trusted by the system.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of the CAs to trust instead of the system roots, e.g. the OPNsense self-signed CA.
+	CAFile string
+	// PinnedSHA256 is the hex encoded SHA-256 fingerprint of the leaf certificate. Colons are ignored.
+	// When set without CAFile, only the fingerprint is checked, so self-signed certificates can be pinned.
+	PinnedSHA256 string
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key presented to OPNsense.
+	ClientCertFile string
+	ClientKeyFile  string
+	// InsecureSkipVerify disables all certificate checks. Only meant for testing.
+	InsecureSkipVerify bool
+}
+
+// NewClientWithTLS creates a Client that verifies OPNsense according to options.
+func NewClientWithTLS(address, apiKey, apiSecret string, options TLSOptions) (Client, error) {
+	tlsConfig, err := NewTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	client := resty.New()
+	client.SetTLSClientConfig(tlsConfig)
+	return &apiKeyClient{
+		apiKey:    apiKey,
+		apiSecret: apiSecret,
+		address:   address,
+		client:    client,
+	}, nil
+}
+
+// NewTLSConfig builds the tls.Config described by options.
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if options.InsecureSkipVerify {
+		log.Warnf("TLS certificate verification of OPNsense is DISABLED. API credentials can be intercepted by anyone in between")
+		tlsConfig.InsecureSkipVerify = true
+		return tlsConfig, nil
+	}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %v does not contain a PEM certificate", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if options.PinnedSHA256 != "" {
+		pin, err := parseFingerprint(options.PinnedSHA256)
+		if err != nil {
+			return nil, err
+		}
+		// the chain is still verified by crypto/tls when a CA file is given
+		tlsConfig.InsecureSkipVerify = options.CAFile == ""
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("OPNsense did not present a certificate")
+			}
+			fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !strings.EqualFold(hex.EncodeToString(fingerprint[:]), pin) {
+				return fmt.Errorf("%w: got %x, want %v", ErrFingerprintMismatch, fingerprint, pin)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+func parseFingerprint(value string) (string, error) {
+	fingerprint := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(value), ":", ""))
+	decoded, err := hex.DecodeString(fingerprint)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("%q is not a hex encoded SHA-256 fingerprint", value)
+	}
+	return fingerprint, nil
+}
@@ -0,0 +1,94 @@
+package opnsense
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	certificate := server.Certificate()
+	fingerprint := sha256.Sum256(certificate.Raw)
+	otherFingerprint := sha256.Sum256([]byte("other certificate"))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), 0o600)
+	if err != nil {
+		t.Fatalf("writing CA file: %v", err)
+	}
+	tests := []struct {
+		name       string
+		options    TLSOptions
+		wantConfig bool
+		wantErr    bool
+	}{
+		{
+			name:       "Reject self-signed certificate by default",
+			options:    TLSOptions{},
+			wantConfig: true,
+			wantErr:    true,
+		},
+		{
+			name:       "Trust CA file",
+			options:    TLSOptions{CAFile: caFile},
+			wantConfig: true,
+			wantErr:    false,
+		},
+		{
+			name:       "Accept pinned fingerprint",
+			options:    TLSOptions{PinnedSHA256: hex.EncodeToString(fingerprint[:])},
+			wantConfig: true,
+			wantErr:    false,
+		},
+		{
+			name:       "Accept pinned fingerprint and CA file",
+			options:    TLSOptions{CAFile: caFile, PinnedSHA256: hex.EncodeToString(fingerprint[:])},
+			wantConfig: true,
+			wantErr:    false,
+		},
+		{
+			name:       "Reject other pinned fingerprint",
+			options:    TLSOptions{PinnedSHA256: hex.EncodeToString(otherFingerprint[:])},
+			wantConfig: true,
+			wantErr:    true,
+		},
+		{
+			name:       "Skip verification when asked to",
+			options:    TLSOptions{InsecureSkipVerify: true},
+			wantConfig: true,
+			wantErr:    false,
+		},
+		{
+			name:       "Reject malformed fingerprint",
+			options:    TLSOptions{PinnedSHA256: "AB:CD"},
+			wantConfig: false,
+		},
+		{
+			name:       "Reject missing CA file",
+			options:    TLSOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+			wantConfig: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClientWithTLS(server.URL, "key", "secret", tt.options)
+			if (err == nil) != tt.wantConfig {
+				t.Errorf("NewClientWithTLS() error = %v, wantConfig %v", err, tt.wantConfig)
+				return
+			}
+			if err != nil {
+				return
+			}
+			err = client.Reconfigure()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
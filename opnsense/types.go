@@ -2,9 +2,18 @@ package opnsense
 
 import (
 	"fmt"
+	"net"
 	"strings"
 )
 
+// ManagedDescriptionMarker is part of the description of every override created by OPNsenseProxyAPI.
+const ManagedDescriptionMarker = "Automatically created by OPNsenseProxyAPI"
+
+// ManagedDescription returns an override description starting with prefix that carries ManagedDescriptionMarker.
+func ManagedDescription(prefix string) string {
+	return fmt.Sprintf("%s %s", prefix, ManagedDescriptionMarker)
+}
+
 type HostOverride struct {
 	UUID        string `json:"uuid"`
 	Enabled     string `json:"enabled"`
@@ -15,15 +24,54 @@ type HostOverride struct {
 	Description string `json:"description"`
 }
 
+const (
+	RecordTypeA    = "A"
+	RecordTypeAAAA = "AAAA"
+)
+
+// RecordTypeForIP returns the record type (A or AAAA) matching the address family of ip.
+func RecordTypeForIP(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("%q is not a valid IP address", ip)
+	}
+	if parsed.To4() != nil {
+		return RecordTypeA, nil
+	}
+	return RecordTypeAAAA, nil
+}
+
+// SplitFQDN splits fqdn into its hostname and the longest of domains it ends with,
+// e.g. "app.lab.example.com" into "app" and "lab.example.com" when both "example.com" and "lab.example.com" are domains.
+// ok is false when fqdn is not below any of domains.
+func SplitFQDN(fqdn string, domains []string) (hostname, domain string, ok bool) {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	for _, candidate := range domains {
+		suffix := "." + strings.TrimSuffix(candidate, ".")
+		if len(fqdn) <= len(suffix) || !strings.EqualFold(fqdn[len(fqdn)-len(suffix):], suffix) {
+			continue
+		}
+		if len(suffix)-1 > len(domain) {
+			hostname, domain, ok = fqdn[:len(fqdn)-len(suffix)], suffix[1:], true
+		}
+	}
+	return hostname, domain, ok
+}
+
+// NewHostOverride creates an A or AAAA host override depending on the address family of server.
 func NewHostOverride(hostname, domain, server string) HostOverride {
+	recordType, err := RecordTypeForIP(server)
+	if err != nil {
+		recordType = RecordTypeA
+	}
 	override := HostOverride{
 		Enabled:  "1",
 		Hostname: hostname,
 		Domain:   domain,
 		Server:   server,
-		Type:     "A",
+		Type:     recordType,
 	}
-	override.Description = fmt.Sprintf("%s Automatically created by OPNsenseProxyAPI", override.GetFQDN())
+	override.Description = ManagedDescription(override.GetFQDN())
 	return override
 }
 
@@ -31,6 +79,25 @@ func (hostOverride HostOverride) GetFQDN() string {
 	return fmt.Sprintf("%s.%s", hostOverride.Hostname, hostOverride.Domain)
 }
 
+// RecordType returns the record type without the description OPNsense adds when listing overrides, e.g. "A (IPv4 address)".
+func (hostOverride HostOverride) RecordType() string {
+	fields := strings.Fields(hostOverride.Type)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// IsManaged reports whether the host override was created by OPNsenseProxyAPI.
+func (hostOverride HostOverride) IsManaged() bool {
+	return strings.Contains(hostOverride.Description, ManagedDescriptionMarker)
+}
+
+// IsAddressRecord reports whether the host override is an A or AAAA record that aliases can point to.
+func (hostOverride HostOverride) IsAddressRecord() bool {
+	return hostOverride.RecordType() == RecordTypeA || hostOverride.RecordType() == RecordTypeAAAA
+}
+
 type AliasOverride struct {
 	UUID        string `json:"uuid"`
 	Enabled     string `json:"enabled"`
@@ -47,7 +114,7 @@ func NewAliasOverride(hostname, domain, host string) AliasOverride {
 		Hostname: hostname,
 		Domain:   domain,
 	}
-	override.Description = fmt.Sprintf("%s Automatically created by OPNsenseProxyAPI", override.GetFQDN())
+	override.Description = ManagedDescription(override.GetFQDN())
 	return override
 }
 
@@ -59,6 +126,43 @@ func (aliasOverride AliasOverride) GetFQDN() string {
 	return fmt.Sprintf("%s.%s", aliasOverride.Hostname, aliasOverride.Domain)
 }
 
+// IsManaged reports whether the alias override was created by OPNsenseProxyAPI.
+func (aliasOverride AliasOverride) IsManaged() bool {
+	return strings.Contains(aliasOverride.Description, ManagedDescriptionMarker)
+}
+
+// AliasPlan lists the alias overrides that ApplyAliasPlan will create and delete for Host.
+// Every alias in Create is added once to each host override record of Host, so that a dual-stack host
+// resolves its aliases to both its A and AAAA records. Delete lists the alias override records of Host
+// to delete, identified by UUID since other hosts may have aliases with the same FQDN.
+type AliasPlan struct {
+	Host string `json:"host"`
+	// Domains are the managed domains the aliases in Create are split on, see SplitFQDN
+	Domains []string        `json:"domains"`
+	Create  []string        `json:"create"`
+	Delete  []AliasOverride `json:"delete"`
+}
+
+func (plan AliasPlan) IsEmpty() bool {
+	return len(plan.Create) == 0 && len(plan.Delete) == 0
+}
+
+// DeleteFQDNs returns the FQDN of every alias override in Delete.
+func (plan AliasPlan) DeleteFQDNs() []string {
+	fqdns := []string{}
+	for _, aliasOverride := range plan.Delete {
+		fqdns = append(fqdns, aliasOverride.GetFQDN())
+	}
+	return fqdns
+}
+
+// AliasSyncResult lists the alias overrides that SyncAliases created and deleted.
+// When SyncAliases fails, it holds the changes made before the failure.
+type AliasSyncResult struct {
+	Created []string `json:"created"`
+	Deleted []string `json:"deleted"`
+}
+
 type addHostOverrideContainer struct {
 	Host HostOverride `json:"host"`
 }
@@ -81,6 +185,15 @@ type addHostAliasContainer struct {
 	Alias AliasOverride `json:"alias"`
 }
 
+type mutationResponse struct {
+	Result string `json:"result"`
+	UUID   string `json:"uuid"`
+}
+
+func (r *mutationResponse) Succeeded() bool {
+	return r.Result == "saved"
+}
+
 type deleteResponse struct {
 	Result string `json:"result"`
 }
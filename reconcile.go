@@ -0,0 +1,149 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reconcileReport describes one reconciliation of every stored host.
+type reconcileReport struct {
+	StartedAt  time.Time             `json:"startedAt"`
+	FinishedAt time.Time             `json:"finishedAt"`
+	Hosts      []hostReconcileResult `json:"hosts"`
+}
+
+// hostReconcileResult tells whether a host drifted from its desired state on a target and which changes repaired it.
+type hostReconcileResult struct {
+	Host   string    `json:"host"`
+	Target string    `json:"target"`
+	Drift  bool      `json:"drift"`
+	Plan   *syncPlan `json:"plan,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// reconciler periodically re-applies the desired state of every host in its store.
+type reconciler struct {
+	store    *stateStore
+	interval time.Duration
+	timeout  time.Duration
+
+	mu         sync.Mutex
+	lastReport *reconcileReport
+}
+
+func newReconciler(store *stateStore, interval time.Duration) *reconciler {
+	return &reconciler{store: store, interval: interval, timeout: 60 * time.Second}
+}
+
+// Run reconciles every interval until ctx is done.
+func (rec *reconciler) Run(ctx context.Context) {
+	log.Infof("Reconciling stored hosts every %v", rec.interval)
+	ticker := time.NewTicker(rec.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rec.reconcile(ctx)
+		}
+	}
+}
+
+func (rec *reconciler) reconcile(ctx context.Context) reconcileReport {
+	report := reconcileReport{StartedAt: time.Now(), Hosts: []hostReconcileResult{}}
+	for _, host := range rec.store.Hosts() {
+		hostCtx, cancel := context.WithTimeout(ctx, rec.timeout)
+		results := rec.reconcileHost(hostCtx, host)
+		cancel()
+		report.Hosts = append(report.Hosts, results...)
+	}
+	report.FinishedAt = time.Now()
+	rec.mu.Lock()
+	rec.lastReport = &report
+	rec.mu.Unlock()
+	return report
+}
+
+// reconcileHost re-applies the desired state of host on every target and returns a result per target.
+func (rec *reconciler) reconcileHost(ctx context.Context, host desiredHost) []hostReconcileResult {
+	results := make([]hostReconcileResult, len(targets))
+	for i, t := range targets {
+		results[i] = hostReconcileResult{Host: host.Host, Target: t.name}
+	}
+	unlock, err := hostLocks.lock(ctx, host.Host)
+	if err != nil {
+		log.Errorf("Error while waiting for a sync of %v: %v", host.Host, err)
+		for i := range results {
+			results[i].Error = err.Error()
+		}
+		return results
+	}
+	defer unlock()
+	// a sync may have changed or deleted the host while waiting for the lock
+	host, ok := rec.store.Get(host.Host)
+	if !ok {
+		return results
+	}
+	forEachTarget(func(i int, t *target) *syncError {
+		results[i] = reconcileTarget(ctx, t, host)
+		return nil
+	})
+	return results
+}
+
+func reconcileTarget(ctx context.Context, t *target, host desiredHost) hostReconcileResult {
+	result := hostReconcileResult{Host: host.Host, Target: t.name}
+	ctx = targetContext(opnsense.WithLogger(ctx, opnsense.Logger(ctx).WithField("host", host.Host)), t)
+	logger := opnsense.Logger(ctx)
+	plan, failure := planSync(ctx, t.client, host.syncRequest(), host.Addresses)
+	if failure != nil {
+		logger.Errorf("Error while reconciling %v: %v", host.Host, failure)
+		result.Error = failure.Error()
+		return result
+	}
+	if !plan.hasChanges() {
+		return result
+	}
+	result.Drift = true
+	result.Plan = plan
+	logger.Warnf("%v drifted from its desired state. Re-applying %v host override changes, %v alias creations and %v alias deletions",
+		host.Host, plan.countHostOverrideChanges(), len(plan.Aliases.Create), len(plan.Aliases.Delete))
+	failure = applySync(ctx, t.client, plan, newTargetSyncResult(t.name))
+	if failure != nil {
+		logger.Errorf("Error while reconciling %v: %v", host.Host, failure)
+		result.Error = failure.Error()
+	}
+	return result
+}
+
+func (rec *reconciler) LastReport() *reconcileReport {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.lastReport
+}
+
+// handleGetReconcileRequest returns the report of the last reconciliation, limited to hosts the caller may manage.
+func handleGetReconcileRequest(w http.ResponseWriter, r *http.Request) {
+	if hostReconciler == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "reconciliation is disabled"})
+		return
+	}
+	lastReport := hostReconciler.LastReport()
+	if lastReport == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "no reconciliation has run yet"})
+		return
+	}
+	report := *lastReport
+	report.Hosts = []hostReconcileResult{}
+	for _, result := range lastReport.Hosts {
+		if isAuthorizedFor(r.Context(), result.Host) {
+			report.Hosts = append(report.Hosts, result)
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// desiredHost is the last successfully synced state of a host, which the reconciler re-applies.
+type desiredHost struct {
+	Host        string   `json:"host"`
+	Aliases     []string `json:"aliases"`
+	Addresses   []string `json:"addresses"`
+	Description string   `json:"description,omitempty"`
+	// ExplicitAddresses is set when the addresses were listed in the request, so records of other address families are deleted.
+	ExplicitAddresses bool `json:"explicitAddresses,omitempty"`
+	// Owner names the provider that manages the host, e.g. the ExternalDNS webhook or a watcher. Hosts synced through
+	// the API have no owner. Owned hosts are kept or deleted by their owner, so their leases never expire.
+	Owner     string    `json:"owner,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ownerName describes the owner of a host for messages.
+func ownerName(owner string) string {
+	if owner == "" {
+		return "a client of the API"
+	}
+	return owner
+}
+
+// syncRequest returns the request that syncs the host to this state.
+func (host desiredHost) syncRequest() syncAliasesRequest {
+	request := syncAliasesRequest{Host: host.Host, Aliases: host.Aliases, Description: host.Description, Owner: host.Owner}
+	if host.ExplicitAddresses {
+		request.Addresses = host.Addresses
+	}
+	return request
+}
+
+// stateStore keeps the desired state of every synced host, persisted as JSON when a path is set.
+type stateStore struct {
+	path  string
+	mu    sync.Mutex
+	hosts map[string]desiredHost
+}
+
+// loadStateStore reads the store at path. A missing file is an empty store and an empty path keeps the state in memory.
+func loadStateStore(path string) (*stateStore, error) {
+	store := &stateStore{path: path, hosts: make(map[string]desiredHost)}
+	if path == "" {
+		return store, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hosts []desiredHost
+	err = json.Unmarshal(content, &hosts)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		store.hosts[host.Host] = host
+	}
+	return store, nil
+}
+
+func (store *stateStore) Put(host desiredHost) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.hosts[host.Host] = host
+	return store.save()
+}
+
+func (store *stateStore) Delete(fqdn string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.hosts, fqdn)
+	return store.save()
+}
+
+func (store *stateStore) Get(fqdn string) (desiredHost, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	host, ok := store.hosts[fqdn]
+	return host, ok
+}
+
+// Hosts returns the stored hosts sorted by FQDN.
+func (store *stateStore) Hosts() []desiredHost {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sortedHosts()
+}
+
+func (store *stateStore) sortedHosts() []desiredHost {
+	hosts := make([]desiredHost, 0, len(store.hosts))
+	for _, host := range store.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// save writes the store to a temporary file first, so a crash never leaves a truncated state file behind.
+func (store *stateStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(store.sortedHosts(), "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), store.path)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type syncAliasesRequest struct {
+	Host        string   `json:"host"`
+	Aliases     []string `json:"aliases"`
+	IP          string   `json:"ip"`
+	Addresses   []string `json:"addresses"`
+	Description string   `json:"description"`
+	// Force allows updating host overrides that were not created by OPNsenseProxyAPI, set by ?force=true.
+	Force bool `json:"-"`
+	// Owner is set for hosts synced on behalf of a provider, see desiredHost.
+	Owner string `json:"-"`
+}
+
+const (
+	hostOverrideCreated   = "created"
+	hostOverrideUpdated   = "updated"
+	hostOverrideDeleted   = "deleted"
+	hostOverrideUnchanged = "unchanged"
+
+	hostOverrideActionCreate = "create"
+	hostOverrideActionUpdate = "update"
+	hostOverrideActionDelete = "delete"
+	hostOverrideActionNone   = "none"
+)
+
+// syncAliasesResponse reports what a sync request changed on every target.
+type syncAliasesResponse struct {
+	Host           string              `json:"host"`
+	DryRun         bool                `json:"dryRun"`
+	Targets        []*targetSyncResult `json:"targets"`
+	LeaseExpiresAt *time.Time          `json:"leaseExpiresAt,omitempty"`
+	Errors         []syncStepError     `json:"errors"`
+}
+
+// targetSyncResult reports what a sync changed on one target. Processing of a target stops at its first error.
+type targetSyncResult struct {
+	Target         string               `json:"target"`
+	Plan           *syncPlan            `json:"plan,omitempty"`
+	HostOverrides  []hostOverrideChange `json:"hostOverrides"`
+	AliasesCreated []string             `json:"aliasesCreated"`
+	AliasesDeleted []string             `json:"aliasesDeleted"`
+	Reconfigured   bool                 `json:"reconfigured"`
+	// ReconfigurePending is set when the reconfiguration of Unbound is scheduled but did not happen yet
+	ReconfigurePending bool            `json:"reconfigurePending"`
+	Errors             []syncStepError `json:"errors"`
+}
+
+// syncPlan describes the changes a sync request makes, or would make in a dry run.
+type syncPlan struct {
+	HostOverrides []hostOverrideChange `json:"hostOverrides"`
+	Aliases       opnsense.AliasPlan   `json:"aliases"`
+}
+
+func (plan *syncPlan) countHostOverrideChanges() int {
+	changes := 0
+	for _, change := range plan.HostOverrides {
+		if change.Action != hostOverrideActionNone {
+			changes++
+		}
+	}
+	return changes
+}
+
+func (plan *syncPlan) hasChanges() bool {
+	return plan.countHostOverrideChanges() > 0 || !plan.Aliases.IsEmpty()
+}
+
+// hostOverrideChange is a planned or applied change to one A or AAAA record of the synced host.
+type hostOverrideChange struct {
+	Type   string `json:"type"`
+	Server string `json:"server"`
+	Action string `json:"action"`
+	// Duplicate marks a second record of the same type, e.g. left behind by concurrent syncs. It is deleted unless it
+	// was not created by OPNsenseProxyAPI.
+	Duplicate    bool `json:"duplicate,omitempty"`
+	hostOverride opnsense.HostOverride
+}
+
+type syncStepError struct {
+	Step  string `json:"step"`
+	Error string `json:"error"`
+}
+
+// syncError is a failed step of a sync together with the HTTP status it is reported with.
+type syncError struct {
+	step   string
+	status int
+	err    error
+}
+
+func (e *syncError) Error() string {
+	return fmt.Sprintf("%v: %v", e.step, e.err)
+}
+
+// upstreamStatus returns the HTTP status for a failed OPNsense call: 504 when the request context expired, 502 otherwise.
+func upstreamStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func newSyncAliasesResponse() *syncAliasesResponse {
+	return &syncAliasesResponse{
+		Targets: []*targetSyncResult{},
+		Errors:  []syncStepError{},
+	}
+}
+
+func (response *syncAliasesResponse) addError(step string, err error) {
+	response.Errors = append(response.Errors, syncStepError{Step: step, Error: err.Error()})
+}
+
+func newTargetSyncResult(name string) *targetSyncResult {
+	return &targetSyncResult{
+		Target:         name,
+		HostOverrides:  []hostOverrideChange{},
+		AliasesCreated: []string{},
+		AliasesDeleted: []string{},
+		Errors:         []syncStepError{},
+	}
+}
+
+func (result *targetSyncResult) addError(step string, err error) {
+	result.Errors = append(result.Errors, syncStepError{Step: step, Error: err.Error()})
+}
+
+func writeSyncFailure(w http.ResponseWriter, response *syncAliasesResponse, failure *syncError) {
+	response.addError(failure.step, failure.err)
+	writeJSON(w, failure.status, response)
+}
+
+func handleSyncAliasesRequest(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var request syncAliasesRequest
+	response := newSyncAliasesResponse()
+	recorder := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	w = recorder
+	defer func() {
+		syncsTotal.WithLabelValues(syncOutcome(recorder.Status(), response.DryRun)).Inc()
+	}()
+	err := decoder.Decode(&request)
+	if err != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while decoding sync request: %v", err)
+		writeSyncFailure(w, response, &syncError{step: "decode", status: http.StatusBadRequest, err: err})
+		return
+	}
+	request.Host = canonicalFQDN(request.Host)
+	for i, alias := range request.Aliases {
+		request.Aliases[i] = canonicalFQDN(alias)
+	}
+	response.Host = request.Host
+	r, logger := withHostLogger(r, request.Host)
+	response.DryRun, err = parseBoolQuery(r, "dryRun")
+	if err != nil {
+		writeSyncFailure(w, response, &syncError{step: "validate", status: http.StatusBadRequest, err: err})
+		return
+	}
+	wait, err := parseBoolQuery(r, "wait")
+	if err != nil {
+		writeSyncFailure(w, response, &syncError{step: "validate", status: http.StatusBadRequest, err: err})
+		return
+	}
+	request.Force, err = parseBoolQuery(r, "force")
+	if err != nil {
+		writeSyncFailure(w, response, &syncError{step: "validate", status: http.StatusBadRequest, err: err})
+		return
+	}
+	if request.Host == "" {
+		writeSyncFailure(w, response, &syncError{step: "validate", status: http.StatusBadRequest, err: errors.New("host is required")})
+		return
+	}
+	fqdns := append([]string{request.Host}, request.Aliases...)
+	if !isAuthorizedFor(r.Context(), fqdns...) {
+		logger.Warnf("Rejecting sync request for %v: token is not allowed to manage [%v]", request.Host, strings.Join(fqdns, ", "))
+		err := fmt.Errorf("token is not allowed to manage [%v]", strings.Join(fqdns, ", "))
+		writeSyncFailure(w, response, &syncError{step: "authorize", status: http.StatusForbidden, err: err})
+		return
+	}
+	addresses, failure := getSyncAddresses(r, request)
+	if failure != nil {
+		logger.Errorf("Error while resolving addresses of %v: %v", request.Host, failure)
+		writeSyncFailure(w, response, failure)
+		return
+	}
+	failure = syncHost(r.Context(), request, addresses, response, wait)
+	if failure != nil {
+		writeSyncFailure(w, response, failure)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// syncHost applies request to every target, recording the outcome in response, and stores it as the desired state of
+// the host when it succeeded. Only the plan is computed when response.DryRun is set. addresses must be normalized.
+// Hosts stored with another owner than request.Owner are rejected, so nobody takes over a host a provider manages.
+func syncHost(ctx context.Context, request syncAliasesRequest, addresses []string, response *syncAliasesResponse, wait bool) *syncError {
+	logger := opnsense.Logger(ctx)
+	unlock, err := hostLocks.lock(ctx, request.Host)
+	if err != nil {
+		logger.Errorf("Error while waiting for another sync of %v: %v", request.Host, err)
+		return &syncError{step: "lock", status: upstreamStatus(err), err: err}
+	}
+	defer unlock()
+	if stored, found := store.Get(request.Host); found && stored.Owner != request.Owner {
+		err := fmt.Errorf("%v is synced by %v", request.Host, ownerName(stored.Owner))
+		logger.Warnf("Rejecting sync of %v: %v", request.Host, err)
+		return &syncError{step: "validate", status: http.StatusConflict, err: err}
+	}
+	for _, t := range targets {
+		response.Targets = append(response.Targets, newTargetSyncResult(t.name))
+	}
+	planFailures := forEachTarget(func(i int, t *target) *syncError {
+		ctx := targetContext(ctx, t)
+		plan, failure := planSync(ctx, t.client, request, addresses)
+		if failure != nil {
+			opnsense.Logger(ctx).Errorf("Error while planning sync of %v: %v", request.Host, failure)
+			response.Targets[i].addError(failure.step, failure.err)
+			return failure
+		}
+		response.Targets[i].Plan = plan
+		return nil
+	})
+	// in syncModeAll, no target is changed unless every target could be planned
+	failure := combineFailures(planFailures)
+	if failure != nil || response.DryRun {
+		return failure
+	}
+	applyFailures := forEachTarget(func(i int, t *target) *syncError {
+		result := response.Targets[i]
+		if result.Plan == nil {
+			return planFailures[i]
+		}
+		ctx := targetContext(ctx, t)
+		failure := applySync(ctx, t.client, result.Plan, result)
+		if failure != nil {
+			opnsense.Logger(ctx).Errorf("Error while syncing %v: %v", request.Host, failure)
+			result.addError(failure.step, failure.err)
+		}
+		return failure
+	})
+	failure = combineFailures(applyFailures)
+	if failure != nil {
+		return failure
+	}
+	host := desiredHost{
+		Host:              request.Host,
+		Aliases:           request.Aliases,
+		Addresses:         addresses,
+		Description:       request.Description,
+		ExplicitAddresses: len(request.Addresses) > 0,
+		Owner:             request.Owner,
+		UpdatedAt:         time.Now(),
+	}
+	err = store.Put(host)
+	if err != nil {
+		logger.Errorf("Error while storing desired state of %v: %v", request.Host, err)
+	}
+	if hostLeases != nil && host.Owner == "" {
+		leaseExpiresAt := hostLeases.expiresAt(host)
+		response.LeaseExpiresAt = &leaseExpiresAt
+	}
+	// other syncs of the host may join the scheduled reconfiguration
+	unlock()
+	failures := forEachTarget(func(i int, t *target) *syncError {
+		result := response.Targets[i]
+		if applyFailures[i] != nil {
+			return applyFailures[i]
+		}
+		var failure *syncError
+		result.Reconfigured, result.ReconfigurePending, failure = awaitReconfigure(ctx, t.scheduler, result.Reconfigured, wait)
+		if failure != nil {
+			opnsense.Logger(targetContext(ctx, t)).Errorf("Error while waiting for Unbound to reconfigure for %v: %v", request.Host, failure)
+			result.addError(failure.step, failure.err)
+		}
+		return failure
+	})
+	return combineFailures(failures)
+}
+
+// awaitReconfigure resolves a requested reconfiguration of Unbound. With a scheduler, it is only scheduled,
+// so it is reported as pending unless wait is set, in which case the scheduled reconfiguration is awaited.
+func awaitReconfigure(ctx context.Context, scheduler *opnsense.ReconfigureScheduler, requested, wait bool) (reconfigured, pending bool, failure *syncError) {
+	if !requested || scheduler == nil {
+		return requested, false, nil
+	}
+	if !wait {
+		return false, true, nil
+	}
+	err := scheduler.Wait(ctx)
+	if err != nil {
+		return false, ctx.Err() != nil, &syncError{step: "reconfigure", status: upstreamStatus(err), err: err}
+	}
+	return true, false, nil
+}
+
+// canonicalFQDN lowercases fqdn and drops surrounding spaces and the trailing dot, so that every spelling of a host
+// shares its lock, its desired state and its records.
+func canonicalFQDN(fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(fqdn), "."))
+}
+
+// splitManagedFQDN splits fqdn into hostname and the longest managed domain it belongs to.
+// FQDNs outside every managed domain are rejected.
+func splitManagedFQDN(fqdn string) (hostname, domain string, failure *syncError) {
+	hostname, domain, ok := opnsense.SplitFQDN(fqdn, domains)
+	if !ok {
+		err := fmt.Errorf("%v is not in one of the managed domains [%v]", fqdn, strings.Join(domains, ", "))
+		return "", "", &syncError{step: "validate", status: http.StatusBadRequest, err: err}
+	}
+	return hostname, domain, nil
+}
+
+// getSyncAddresses returns the validated addresses of the request. Without explicit addresses, the request's ip
+// or else the caller's address is used. At most one address per address family is allowed.
+func getSyncAddresses(r *http.Request, request syncAliasesRequest) ([]string, *syncError) {
+	if request.IP != "" && len(request.Addresses) > 0 {
+		return nil, &syncError{step: "validate", status: http.StatusBadRequest, err: errors.New("ip and addresses cannot be combined")}
+	}
+	if request.IP != "" {
+		request.Addresses = []string{request.IP}
+	}
+	if len(request.Addresses) == 0 {
+		hostIP, err := getIPAddress(r)
+		if err != nil {
+			return nil, &syncError{step: "resolveIP", status: http.StatusInternalServerError, err: err}
+		}
+		request.Addresses = []string{hostIP}
+	}
+	return normalizeAddresses(request.Addresses)
+}
+
+// normalizeAddresses validates addresses, allowing at most one per address family, and returns them in canonical form.
+func normalizeAddresses(requested []string) ([]string, *syncError) {
+	var addresses []string
+	recordTypes := make(map[string]bool)
+	for _, address := range requested {
+		recordType, err := opnsense.RecordTypeForIP(address)
+		if err != nil {
+			return nil, &syncError{step: "validate", status: http.StatusBadRequest, err: err}
+		}
+		if recordTypes[recordType] {
+			return nil, &syncError{step: "validate", status: http.StatusBadRequest, err: fmt.Errorf("more than one address for record type %v", recordType)}
+		}
+		recordTypes[recordType] = true
+		addresses = append(addresses, net.ParseIP(address).String())
+	}
+	return addresses, nil
+}
+
+// planSync computes the host override changes for addresses and the alias changes for the request without changing OPNsense.
+// Records of an address family missing from addresses are only deleted when the request lists its addresses explicitly.
+// Like DELETE /hosts without force, records that were not created by OPNsenseProxyAPI are never deleted, and they are
+// only updated when request.Force is set.
+func planSync(ctx context.Context, client opnsense.Client, request syncAliasesRequest, addresses []string) (*syncPlan, *syncError) {
+	logger := opnsense.Logger(ctx)
+	hostname, domain, failure := splitManagedFQDN(request.Host)
+	if failure != nil {
+		return nil, failure
+	}
+	for _, alias := range request.Aliases {
+		if _, _, failure := splitManagedFQDN(alias); failure != nil {
+			return nil, failure
+		}
+	}
+	records, err := client.GetHostOverrideRecordsContext(ctx, request.Host)
+	if err != nil {
+		return nil, &syncError{step: "checkHostOverride", status: upstreamStatus(err), err: err}
+	}
+	records, duplicates := splitDuplicateRecords(records, addresses)
+	plan := &syncPlan{HostOverrides: []hostOverrideChange{}}
+	for _, address := range addresses {
+		hostOverride := opnsense.NewHostOverride(hostname, domain, address)
+		if request.Description != "" {
+			hostOverride.Description = opnsense.ManagedDescription(request.Description)
+		}
+		change := hostOverrideChange{Type: hostOverride.Type, Server: address, Action: hostOverrideActionNone, hostOverride: hostOverride}
+		existing, found := findHostOverrideRecord(records, hostOverride.Type)
+		if !found {
+			change.Action = hostOverrideActionCreate
+		} else if needsHostOverrideUpdate(existing, hostOverride, request.Description != "") {
+			if !existing.IsManaged() && !request.Force {
+				return nil, &syncError{step: "validate", status: http.StatusConflict, err: fmt.Errorf("%v host override %v was not created by OPNsenseProxyAPI", existing.RecordType(), request.Host)}
+			}
+			change.Action = hostOverrideActionUpdate
+			change.hostOverride.UUID = existing.UUID
+			// a forced update takes the record over, so it keeps the description of OPNsenseProxyAPI
+			if request.Description == "" && existing.IsManaged() {
+				change.hostOverride.Description = existing.Description
+			}
+		}
+		plan.HostOverrides = append(plan.HostOverrides, change)
+	}
+	for _, record := range records {
+		if !record.IsAddressRecord() || isPlanned(plan.HostOverrides, record.RecordType()) {
+			continue
+		}
+		change := hostOverrideChange{Type: record.RecordType(), Server: record.Server, Action: hostOverrideActionNone, hostOverride: record}
+		if len(request.Addresses) > 0 {
+			if record.IsManaged() {
+				change.Action = hostOverrideActionDelete
+			} else {
+				logger.Warnf("Not deleting %v host override %v with IP (%v): it was not created by OPNsenseProxyAPI", record.RecordType(), record.GetFQDN(), record.Server)
+			}
+		}
+		plan.HostOverrides = append(plan.HostOverrides, change)
+	}
+	for _, duplicate := range duplicates {
+		change := hostOverrideChange{
+			Type:         duplicate.RecordType(),
+			Server:       duplicate.Server,
+			Action:       hostOverrideActionNone,
+			Duplicate:    true,
+			hostOverride: duplicate,
+		}
+		if duplicate.IsManaged() {
+			logger.Warnf("Found duplicate %v host override %v with IP (%v)", duplicate.RecordType(), duplicate.GetFQDN(), duplicate.Server)
+			change.Action = hostOverrideActionDelete
+		} else {
+			logger.Warnf("Not deleting duplicate %v host override %v with IP (%v): it was not created by OPNsenseProxyAPI", duplicate.RecordType(), duplicate.GetFQDN(), duplicate.Server)
+		}
+		plan.HostOverrides = append(plan.HostOverrides, change)
+	}
+	remainingRecords := 0
+	for _, change := range plan.HostOverrides {
+		if change.Action != hostOverrideActionDelete {
+			remainingRecords++
+		}
+	}
+	plan.Aliases, err = client.PlanAliasesInDomainsContext(ctx, request.Host, request.Aliases, domains, remainingRecords)
+	if err != nil {
+		return nil, &syncError{step: "planAliases", status: upstreamStatus(err), err: err}
+	}
+	return plan, nil
+}
+
+// applySync applies plan and records every applied change in result.
+func applySync(ctx context.Context, client opnsense.Client, plan *syncPlan, result *targetSyncResult) *syncError {
+	logger := opnsense.Logger(ctx)
+	hostOverridesChanged := false
+	for _, change := range plan.HostOverrides {
+		applied := change
+		var step string
+		var changed bool
+		var err error
+		switch change.Action {
+		case hostOverrideActionCreate:
+			logger.Infof("Creating %v host override %v with IP (%v)", change.Type, change.hostOverride.GetFQDN(), change.Server)
+			step, applied.Action = "createHostOverride", hostOverrideCreated
+			changed, err = client.CreateHostOverrideContext(ctx, change.hostOverride)
+			if err == nil && changed {
+				hostOverridesCreatedTotal.Inc()
+			}
+		case hostOverrideActionUpdate:
+			logger.Infof("Updating %v host override %v to IP (%v)", change.Type, change.hostOverride.GetFQDN(), change.Server)
+			step, applied.Action = "updateHostOverride", hostOverrideUpdated
+			changed, err = client.UpdateHostOverrideContext(ctx, change.hostOverride)
+		case hostOverrideActionDelete:
+			logger.Infof("Deleting %v host override %v with IP (%v)", change.Type, change.hostOverride.GetFQDN(), change.Server)
+			step, applied.Action = "deleteHostOverride", hostOverrideDeleted
+			changed, err = client.DeleteHostOverrideRecordContext(ctx, change.hostOverride)
+		default:
+			applied.Action = hostOverrideUnchanged
+			result.HostOverrides = append(result.HostOverrides, applied)
+			continue
+		}
+		if err == nil && !changed {
+			err = fmt.Errorf("OPNsense did not %v %v host override %v", change.Action, change.Type, change.hostOverride.GetFQDN())
+		}
+		if err != nil {
+			return &syncError{step: step, status: upstreamStatus(err), err: err}
+		}
+		result.HostOverrides = append(result.HostOverrides, applied)
+		hostOverridesChanged = true
+	}
+	// sync aliases
+	aliases, err := client.ApplyAliasPlanContext(ctx, plan.Aliases)
+	result.AliasesCreated = aliases.Created
+	result.AliasesDeleted = aliases.Deleted
+	aliasesCreatedTotal.Add(float64(len(aliases.Created)))
+	aliasesDeletedTotal.Add(float64(len(aliases.Deleted)))
+	if err != nil {
+		return &syncError{step: "syncAliases", status: upstreamStatus(err), err: err}
+	}
+	// every restart of Unbound drops queries, so reconfigure once and only when something changed
+	if !hostOverridesChanged && len(aliases.Created) == 0 && len(aliases.Deleted) == 0 {
+		return nil
+	}
+	err = client.ReconfigureContext(ctx)
+	if err != nil {
+		return &syncError{step: "reconfigure", status: upstreamStatus(err), err: err}
+	}
+	result.Reconfigured = true
+	return nil
+}
+
+func findHostOverrideRecord(records []opnsense.HostOverride, recordType string) (opnsense.HostOverride, bool) {
+	for _, record := range records {
+		if record.RecordType() == recordType {
+			return record, true
+		}
+	}
+	return opnsense.HostOverride{}, false
+}
+
+// splitDuplicateRecords keeps one address record per record type and returns the others as duplicates.
+// Of several records of a type, the one already pointing to the wanted address is kept, otherwise the first one.
+func splitDuplicateRecords(records []opnsense.HostOverride, addresses []string) (kept, duplicates []opnsense.HostOverride) {
+	keep := make(map[string]int)
+	for _, address := range addresses {
+		for i, record := range records {
+			if _, found := keep[record.RecordType()]; !found && record.IsAddressRecord() && record.Server == address {
+				keep[record.RecordType()] = i
+			}
+		}
+	}
+	for i, record := range records {
+		if _, found := keep[record.RecordType()]; !found && record.IsAddressRecord() {
+			keep[record.RecordType()] = i
+		}
+	}
+	for i, record := range records {
+		if record.IsAddressRecord() && keep[record.RecordType()] != i {
+			duplicates = append(duplicates, record)
+			continue
+		}
+		kept = append(kept, record)
+	}
+	return kept, duplicates
+}
+
+func isPlanned(changes []hostOverrideChange, recordType string) bool {
+	for _, change := range changes {
+		if change.Type == recordType {
+			return true
+		}
+	}
+	return false
+}
+
+// needsHostOverrideUpdate reports whether existing points to a different IP than desired,
+// or carries a different description when one was requested.
+func needsHostOverrideUpdate(existing, desired opnsense.HostOverride, compareDescription bool) bool {
+	if existing.Server != desired.Server {
+		return true
+	}
+	return compareDescription && existing.Description != desired.Description
+}
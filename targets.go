@@ -0,0 +1,126 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Modes for changes to several targets.
+const (
+	// syncModeAll reports a change as failed unless it succeeded on every target. A sync changes nothing
+	// unless it could be planned on every target.
+	syncModeAll = "all"
+	// syncModeBestEffort applies a change to every target it can and reports it as failed only when no target succeeded.
+	syncModeBestEffort = "best-effort"
+)
+
+var targets []*target
+var syncMode = syncModeAll
+
+// target is one OPNsense firewall, e.g. a node of a CARP pair. Every target has its own client and, when
+// reconfigurations are debounced, its own scheduler.
+type target struct {
+	name      string
+	client    opnsense.Client
+	scheduler *opnsense.ReconfigureScheduler
+}
+
+// newTarget connects to the firewall of targetConfig. A quietPeriod of 0 reconfigures Unbound right after every change.
+func newTarget(targetConfig opnsenseConfig, quietPeriod, maxDelay time.Duration) (*target, error) {
+	client, err := opnsense.NewObservedClientWithTLS(targetConfig.Address, targetConfig.APIKey, targetConfig.APISecret,
+		targetConfig.tlsOptions(), metricsObserver{target: targetConfig.Name})
+	if err != nil {
+		return nil, err
+	}
+	t := &target{name: targetConfig.Name, client: client}
+	if quietPeriod > 0 {
+		t.scheduler = opnsense.NewReconfigureScheduler(client, quietPeriod, maxDelay)
+		t.client = t.scheduler.Client()
+	}
+	return t, nil
+}
+
+// findTarget returns the target named in the target query parameter, or the first target without one.
+func findTarget(r *http.Request) (*target, error) {
+	name := r.URL.Query().Get("target")
+	if name == "" {
+		return targets[0], nil
+	}
+	for _, t := range targets {
+		if t.name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown target %q", name)
+}
+
+// forEachTarget calls fn for every target concurrently and returns the failures in the order of targets.
+func forEachTarget(fn func(i int, t *target) *syncError) []*syncError {
+	failures := make([]*syncError, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+			failures[i] = fn(i, t)
+		}(i, t)
+	}
+	wg.Wait()
+	return failures
+}
+
+// combineFailures returns the failure a change to every target is reported with according to syncMode,
+// or nil when it succeeded. It is the first failure, prefixed with the name of its target.
+func combineFailures(failures []*syncError) *syncError {
+	var first *syncError
+	succeeded := 0
+	for i, failure := range failures {
+		if failure == nil {
+			succeeded++
+			continue
+		}
+		if first == nil {
+			first = &syncError{step: failure.step, status: failure.status, err: fmt.Errorf("target %v: %w", targets[i].name, failure.err)}
+		}
+	}
+	if enoughTargetsSucceeded(succeeded) {
+		return nil
+	}
+	return first
+}
+
+// enoughTargetsSucceeded tells whether a change that succeeded on that many targets succeeded according to syncMode.
+func enoughTargetsSucceeded(succeeded int) bool {
+	if syncMode == syncModeBestEffort {
+		return succeeded > 0
+	}
+	return succeeded == len(targets)
+}
+
+// ignoreFailures drops the failures with one of statuses, unless every target failed with one of them.
+func ignoreFailures(failures []*syncError, statuses ...int) []*syncError {
+	kept := make([]*syncError, len(failures))
+	onlyIgnored := true
+	for i, failure := range failures {
+		if failure == nil || !hasStatus(failure, statuses) {
+			onlyIgnored = false
+			kept[i] = failure
+		}
+	}
+	if onlyIgnored {
+		return failures
+	}
+	return kept
+}
+
+func hasStatus(failure *syncError, statuses []int) bool {
+	for _, status := range statuses {
+		if failure.status == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package traefik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Router is an HTTP or TCP router as listed by the Traefik API.
+type Router struct {
+	Name     string `json:"name"`
+	Rule     string `json:"rule"`
+	Status   string `json:"status"`
+	Provider string `json:"provider"`
+}
+
+// IsEnabled reports whether Traefik serves the router. Routers with warnings are served, too.
+func (router Router) IsEnabled() bool {
+	return router.Status != "disabled"
+}
+
+// Client lists the routers of Traefik through its API, e.g. http://traefik:8080.
+// Credentials of the API can be given as part of the URL.
+type Client struct {
+	client *resty.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{client: resty.New().SetBaseURL(strings.TrimSuffix(url, "/"))}
+}
+
+// Routers lists the HTTP and TCP routers.
+func (c *Client) Routers(ctx context.Context) ([]Router, error) {
+	var routers []Router
+	for _, path := range []string{"/api/http/routers", "/api/tcp/routers"} {
+		pathRouters, err := c.listRouters(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		routers = append(routers, pathRouters...)
+	}
+	return routers, nil
+}
+
+// listRouters reads every page of path. The API returns up to per_page routers and the next page in X-Next-Page.
+func (c *Client) listRouters(ctx context.Context, path string) ([]Router, error) {
+	var routers []Router
+	page := "1"
+	for {
+		var pageRouters []Router
+		resp, err := c.client.R().
+			SetContext(ctx).
+			SetQueryParams(map[string]string{"page": page, "per_page": "100"}).
+			SetResult(&pageRouters).
+			Get(path)
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("%v: %v", path, resp.Status())
+		}
+		routers = append(routers, pageRouters...)
+		next := resp.Header().Get("X-Next-Page")
+		if next == "" || next == page {
+			return routers, nil
+		}
+		if _, err := strconv.Atoi(next); err != nil {
+			return nil, errors.New("invalid X-Next-Page " + next)
+		}
+		page = next
+	}
+}
+
+var (
+	hostMatcher = regexp.MustCompile("(!\\s*)?\\b(Host|HostHeader|HostSNI)\\s*\\(([^)]*)\\)")
+	quoted      = regexp.MustCompile("`([^`]*)`|\"([^\"]*)\"")
+)
+
+// Hosts returns the hostnames of the Host and HostSNI matchers of rule, e.g. "a.example.com" and "b.example.com"
+// of "Host(`a.example.com`, `b.example.com`) && PathPrefix(`/api`)". Negated matchers and wildcards are skipped.
+func Hosts(rule string) []string {
+	var hosts []string
+	for _, matcher := range hostMatcher.FindAllStringSubmatch(rule, -1) {
+		if matcher[1] != "" {
+			continue
+		}
+		for _, argument := range quoted.FindAllStringSubmatch(matcher[3], -1) {
+			host := strings.ToLower(strings.TrimSpace(argument[1] + argument[2]))
+			if host == "" || strings.ContainsAny(host, "*{") {
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
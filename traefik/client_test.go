@@ -0,0 +1,78 @@
+package traefik
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHosts(t *testing.T) {
+	tests := []struct {
+		rule string
+		want []string
+	}{
+		{rule: "Host(`app1.example.com`)", want: []string{"app1.example.com"}},
+		{rule: "Host(`App1.example.com`, `app2.example.com`) && PathPrefix(`/api`)", want: []string{"app1.example.com", "app2.example.com"}},
+		{rule: "(Host(`app1.example.com`) || Host(\"app2.example.com\")) && !Host(`app3.example.com`)", want: []string{"app1.example.com", "app2.example.com"}},
+		{rule: "HostSNI(`db.example.com`)", want: []string{"db.example.com"}},
+		{rule: "HostSNI(`*`)", want: nil},
+		{rule: "HostRegexp(`{subdomain:[a-z]+}.example.com`)", want: nil},
+		{rule: "PathPrefix(`/`)", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			if got := Hosts(tt.rule); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Routers(t *testing.T) {
+	pages := map[string][]Router{
+		"1": {{Name: "app1@docker", Rule: "Host(`app1.example.com`)", Status: "enabled"}},
+		"2": {{Name: "app2@docker", Rule: "Host(`app2.example.com`)", Status: "disabled"}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if username != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/http/routers":
+			page := r.URL.Query().Get("page")
+			if page == "1" {
+				w.Header().Set("X-Next-Page", "2")
+			}
+			_ = json.NewEncoder(w).Encode(pages[page])
+		case "/api/tcp/routers":
+			_ = json.NewEncoder(w).Encode([]Router{{Name: "db@file", Rule: "HostSNI(`db.example.com`)", Status: "enabled"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient("http://admin:secret@" + server.Listener.Addr().String() + "/")
+	routers, err := client.Routers(context.Background())
+	if err != nil {
+		t.Fatalf("Routers() error = %v", err)
+	}
+	var names []string
+	for _, router := range routers {
+		names = append(names, router.Name)
+	}
+	if want := []string{"app1@docker", "app2@docker", "db@file"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Routers() got %v, want %v", names, want)
+	}
+
+	_, err = NewClient(server.URL).Routers(context.Background())
+	if err == nil {
+		t.Errorf("Routers() without credentials error = nil, want error")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/traefik"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultTraefikURL is the API of Traefik with the default entrypoint "traefik" and api.insecure enabled.
+const defaultTraefikURL = "http://localhost:8080"
+
+// traefikWatcher polls the routers of Traefik and syncs the hostnames of their Host and HostSNI rules as aliases of the watched host.
+type traefikWatcher struct {
+	client   *traefik.Client
+	interval time.Duration
+	watcher  *aliasWatcher
+}
+
+func newTraefikWatcher(cfg watchConfig) (*traefikWatcher, error) {
+	if cfg.Traefik.URL == "" {
+		cfg.Traefik.URL = defaultTraefikURL
+	}
+	interval, err := parseDuration(cfg.Traefik.PollInterval, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("parsing TRAEFIK_POLL_INTERVAL: %w", err)
+	}
+	if interval <= 0 {
+		return nil, errors.New("TRAEFIK_POLL_INTERVAL must be positive")
+	}
+	w := &traefikWatcher{client: traefik.NewClient(cfg.Traefik.URL), interval: interval}
+	w.watcher, err = newAliasWatcher("traefik", cfg, w.aliases)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Run syncs the hostnames of the routers every interval until ctx is done.
+func (w *traefikWatcher) Run(ctx context.Context) {
+	w.watcher.poll(ctx, w.interval)
+}
+
+// aliases returns the hostnames of the enabled routers.
+func (w *traefikWatcher) aliases(ctx context.Context) ([]string, error) {
+	routers, err := w.client.Routers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, router := range routers {
+		if router.IsEnabled() {
+			aliases = append(aliases, traefik.Hosts(router.Rule)...)
+		}
+	}
+	return aliases, nil
+}
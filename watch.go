@@ -0,0 +1,162 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// aliasWatcher syncs the aliases discovered by a source, e.g. the labels of containers, as the aliases of one host.
+// It uses the same sync as POST /sync, so the host and its aliases are stored and reconciled alike. The source owns
+// the host, see desiredHost, so its lease does not expire while the watcher waits for changes.
+type aliasWatcher struct {
+	source        string
+	host          string
+	addresses     []string
+	discover      func(ctx context.Context) ([]string, error)
+	timeout       time.Duration
+	retryInterval time.Duration
+	// skipped are the aliases outside the managed domains that were already warned about
+	skipped map[string]bool
+}
+
+func newAliasWatcher(source string, cfg watchConfig, discover func(ctx context.Context) ([]string, error)) (*aliasWatcher, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("WATCH_HOST not set")
+	}
+	if _, _, failure := splitManagedFQDN(cfg.Host); failure != nil {
+		return nil, failure.err
+	}
+	if len(cfg.Addresses) == 0 {
+		return nil, errors.New("WATCH_ADDRESSES not set")
+	}
+	addresses, failure := normalizeAddresses(cfg.Addresses)
+	if failure != nil {
+		return nil, failure.err
+	}
+	return &aliasWatcher{
+		source:        source,
+		host:          canonicalFQDN(cfg.Host),
+		addresses:     addresses,
+		discover:      discover,
+		timeout:       60 * time.Second,
+		retryInterval: 10 * time.Second,
+		skipped:       make(map[string]bool),
+	}, nil
+}
+
+// run syncs once and then whenever trigger fires, until ctx is done. Failed syncs are retried after retryInterval.
+func (w *aliasWatcher) run(ctx context.Context, trigger <-chan struct{}) {
+	log.Infof("Syncing the aliases of %v found by %v", w.host, w.source)
+	runSyncs(ctx, fmt.Sprintf("the aliases of %v found by %v", w.host, w.source), trigger, w.retryInterval, w.sync)
+}
+
+// runSyncs calls sync once and then whenever trigger fires, until ctx is done. Failed syncs of what are logged and
+// retried after retryInterval.
+func runSyncs(ctx context.Context, what string, trigger <-chan struct{}, retryInterval time.Duration, sync func(ctx context.Context) error) {
+	for {
+		var retry <-chan time.Time
+		err := sync(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("Error while syncing %v: %v", what, err)
+			retry = time.After(retryInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-retry:
+		}
+	}
+}
+
+// poll syncs once and then every interval until ctx is done.
+func (w *aliasWatcher) poll(ctx context.Context, interval time.Duration) {
+	trigger := make(chan struct{}, 1)
+	go notifyEvery(ctx, interval, trigger)
+	w.run(ctx, trigger)
+}
+
+// sync discovers the aliases and syncs them.
+func (w *aliasWatcher) sync(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	discovered, err := w.discover(ctx)
+	if err != nil {
+		return fmt.Errorf("discovering aliases: %w", err)
+	}
+	return w.syncAliases(ctx, discovered)
+}
+
+// syncAliases syncs discovered as the aliases of the host. Aliases outside the managed domains are skipped.
+func (w *aliasWatcher) syncAliases(ctx context.Context, discovered []string) error {
+	logger := opnsense.Logger(ctx).WithFields(log.Fields{"source": w.source, "host": w.host})
+	ctx = opnsense.WithLogger(ctx, logger)
+	aliases := w.filterAliases(logger, discovered)
+	request := syncAliasesRequest{Host: w.host, Aliases: aliases, Addresses: w.addresses, Owner: w.source}
+	response := newSyncAliasesResponse()
+	response.Host = w.host
+	failure := syncHost(ctx, request, w.addresses, response, false)
+	status := http.StatusOK
+	if failure != nil {
+		status = failure.status
+	}
+	syncsTotal.WithLabelValues(syncOutcome(status, false)).Inc()
+	if failure != nil {
+		return failure
+	}
+	logger.Debugf("Synced aliases [%v]", strings.Join(aliases, ", "))
+	return nil
+}
+
+// filterAliases lowercases and sorts aliases, dropping duplicates, the host itself and FQDNs outside the managed domains.
+// Every skipped FQDN is only warned about once.
+func (w *aliasWatcher) filterAliases(logger *log.Entry, discovered []string) []string {
+	aliases := []string{}
+	seen := map[string]bool{w.host: true}
+	for _, alias := range discovered {
+		alias = canonicalFQDN(alias)
+		if alias == "" || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		if _, _, failure := splitManagedFQDN(alias); failure != nil {
+			if !w.skipped[alias] {
+				logger.Warnf("Skipping alias found by %v: %v", w.source, failure.err)
+				w.skipped[alias] = true
+			}
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// notify fires trigger unless a sync is already pending, so bursts of changes cause a single sync.
+func notify(trigger chan<- struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// notifyEvery fires trigger every interval until ctx is done.
+func notifyEvery(ctx context.Context, interval time.Duration, trigger chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify(trigger)
+		}
+	}
+}
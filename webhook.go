@@ -0,0 +1,387 @@
+package main
+
+import (
+	"OPNsenseProxyAPI/opnsense"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookMediaType is the content type of the ExternalDNS webhook protocol.
+	webhookMediaType = "application/external.dns.webhook+json;version=1"
+	// webhookOwner owns the hosts created through the webhook, see desiredHost.
+	webhookOwner = "external-dns"
+)
+
+// webhookMu serializes changes, which read and update the desired state of several hosts.
+var webhookMu sync.Mutex
+
+// webhookEndpoint is a DNS record as ExternalDNS sends and expects it.
+type webhookEndpoint struct {
+	DNSName          string                    `json:"dnsName"`
+	Targets          []string                  `json:"targets"`
+	RecordType       string                    `json:"recordType"`
+	SetIdentifier    string                    `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                     `json:"recordTTL,omitempty"`
+	Labels           map[string]string         `json:"labels,omitempty"`
+	ProviderSpecific []webhookProviderSpecific `json:"providerSpecific,omitempty"`
+}
+
+type webhookProviderSpecific struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// webhookChanges are the records ExternalDNS wants created, updated and deleted. Updates list every record before
+// and after the change.
+type webhookChanges struct {
+	Create    []*webhookEndpoint `json:"Create"`
+	UpdateOld []*webhookEndpoint `json:"UpdateOld"`
+	UpdateNew []*webhookEndpoint `json:"UpdateNew"`
+	Delete    []*webhookEndpoint `json:"Delete"`
+}
+
+// webhookDomainFilter tells ExternalDNS which domains the webhook manages.
+type webhookDomainFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// newWebhookRouter serves the ExternalDNS webhook protocol. A and AAAA records become host overrides and CNAME records
+// become aliases of the host override they point to, which must be an A or AAAA record of the webhook, too.
+func newWebhookRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(accessLog)
+	r.Use(middleware.Recoverer)
+	r.Use(middleware.Timeout(60 * time.Second))
+	r.Get("/", handleWebhookNegotiateRequest)
+	r.Get("/records", handleWebhookGetRecordsRequest)
+	r.Post("/records", handleWebhookApplyChangesRequest)
+	r.Post("/adjustendpoints", handleWebhookAdjustEndpointsRequest)
+	r.Get("/healthz", handleHealthzRequest)
+	return r
+}
+
+func writeWebhookJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", webhookMediaType)
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Errorf("Error while encoding response: %v", err)
+	}
+}
+
+// handleWebhookNegotiateRequest answers the managed domains.
+func handleWebhookNegotiateRequest(w http.ResponseWriter, r *http.Request) {
+	writeWebhookJSON(w, http.StatusOK, webhookDomainFilter{Include: domains})
+}
+
+// handleWebhookGetRecordsRequest lists the records of the hosts owned by the webhook.
+func handleWebhookGetRecordsRequest(w http.ResponseWriter, r *http.Request) {
+	writeWebhookJSON(w, http.StatusOK, webhookRecords())
+}
+
+func handleWebhookApplyChangesRequest(w http.ResponseWriter, r *http.Request) {
+	var changes webhookChanges
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while decoding webhook changes: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	failure := applyWebhookChanges(r.Context(), changes)
+	if failure != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while applying webhook changes: %v", failure)
+		http.Error(w, failure.Error(), failure.status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleWebhookAdjustEndpointsRequest(w http.ResponseWriter, r *http.Request) {
+	var endpoints []*webhookEndpoint
+	err := json.NewDecoder(r.Body).Decode(&endpoints)
+	if err != nil {
+		opnsense.Logger(r.Context()).Errorf("Error while decoding webhook endpoints: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeWebhookJSON(w, http.StatusOK, adjustWebhookEndpoints(endpoints))
+}
+
+// webhookRecords returns an A or AAAA record for every address and a CNAME record for every alias of the hosts owned
+// by the webhook, sorted by name and type.
+func webhookRecords() []*webhookEndpoint {
+	endpoints := []*webhookEndpoint{}
+	for _, host := range store.Hosts() {
+		if host.Owner != webhookOwner {
+			continue
+		}
+		for _, address := range host.Addresses {
+			recordType, err := opnsense.RecordTypeForIP(address)
+			if err != nil {
+				continue
+			}
+			endpoints = append(endpoints, &webhookEndpoint{DNSName: host.Host, Targets: []string{address}, RecordType: recordType})
+		}
+		for _, alias := range host.Aliases {
+			endpoints = append(endpoints, &webhookEndpoint{DNSName: alias, Targets: []string{host.Host}, RecordType: "CNAME"})
+		}
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		if endpoints[i].DNSName != endpoints[j].DNSName {
+			return endpoints[i].DNSName < endpoints[j].DNSName
+		}
+		return endpoints[i].RecordType < endpoints[j].RecordType
+	})
+	return endpoints
+}
+
+// adjustWebhookEndpoints makes the desired records look like the records the webhook lists, so that ExternalDNS does
+// not update them on every run: names are lowercased, A, AAAA and CNAME records keep their first target only, and TTLs
+// are dropped since Unbound overrides have none.
+func adjustWebhookEndpoints(endpoints []*webhookEndpoint) []*webhookEndpoint {
+	adjusted := []*webhookEndpoint{}
+	for _, endpoint := range endpoints {
+		endpoint.DNSName = canonicalFQDN(endpoint.DNSName)
+		endpoint.RecordTTL = 0
+		if isWebhookRecordType(endpoint.RecordType) && len(endpoint.Targets) > 1 {
+			endpoint.Targets = endpoint.Targets[:1]
+		}
+		if endpoint.RecordType == "CNAME" {
+			for i, target := range endpoint.Targets {
+				endpoint.Targets[i] = canonicalFQDN(target)
+			}
+		}
+		adjusted = append(adjusted, endpoint)
+	}
+	return adjusted
+}
+
+func isWebhookRecordType(recordType string) bool {
+	return recordType == opnsense.RecordTypeA || recordType == opnsense.RecordTypeAAAA || recordType == "CNAME"
+}
+
+// applyWebhookChanges computes the desired state of every host the changes touch and syncs it: deletions are applied
+// first, then A and AAAA records, then CNAME records, so a CNAME may point to a host created by the same changes.
+// Hosts without addresses left are deleted. Hosts synced by other clients and overrides that were not created by
+// OPNsenseProxyAPI cannot be changed.
+func applyWebhookChanges(ctx context.Context, changes webhookChanges) *syncError {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	hosts := make(map[string]*desiredHost)
+	for _, host := range store.Hosts() {
+		if host.Owner == webhookOwner {
+			host := host
+			hosts[host.Host] = &host
+		}
+	}
+	changed := make(map[string]bool)
+	for _, endpoint := range append(append([]*webhookEndpoint{}, changes.Delete...), changes.UpdateOld...) {
+		failure := removeWebhookRecord(hosts, endpoint, changed)
+		if failure != nil {
+			return failure
+		}
+	}
+	created := append(append([]*webhookEndpoint{}, changes.Create...), changes.UpdateNew...)
+	for _, endpoint := range created {
+		if endpoint.RecordType != "CNAME" {
+			failure := addWebhookAddress(ctx, hosts, endpoint, changed)
+			if failure != nil {
+				return failure
+			}
+		}
+	}
+	for _, endpoint := range created {
+		if endpoint.RecordType == "CNAME" {
+			failure := addWebhookAlias(ctx, hosts, endpoint, changed)
+			if failure != nil {
+				return failure
+			}
+		}
+	}
+	fqdns := make([]string, 0, len(changed))
+	for fqdn := range changed {
+		fqdns = append(fqdns, fqdn)
+	}
+	sort.Strings(fqdns)
+	for _, fqdn := range fqdns {
+		failure := syncWebhookHost(ctx, hosts[fqdn])
+		if failure != nil {
+			return failure
+		}
+	}
+	return nil
+}
+
+// webhookRecord validates the type and name of endpoint and returns its normalized name and first target.
+func webhookRecord(endpoint *webhookEndpoint) (name, target string, failure *syncError) {
+	if !isWebhookRecordType(endpoint.RecordType) {
+		err := fmt.Errorf("record type %v of %v is not supported, only A, AAAA and CNAME", endpoint.RecordType, endpoint.DNSName)
+		return "", "", &syncError{step: "validate", status: http.StatusBadRequest, err: err}
+	}
+	if len(endpoint.Targets) == 0 {
+		err := fmt.Errorf("%v record %v has no target", endpoint.RecordType, endpoint.DNSName)
+		return "", "", &syncError{step: "validate", status: http.StatusBadRequest, err: err}
+	}
+	name = canonicalFQDN(endpoint.DNSName)
+	if _, _, failure := splitManagedFQDN(name); failure != nil {
+		return "", "", failure
+	}
+	target = strings.TrimSpace(endpoint.Targets[0])
+	if endpoint.RecordType == "CNAME" {
+		target = canonicalFQDN(target)
+	}
+	return name, target, nil
+}
+
+// ownedWebhookHost returns the host fqdn owned by the webhook, or nil if there is none. It fails if another client
+// synced fqdn.
+func ownedWebhookHost(hosts map[string]*desiredHost, fqdn string) (*desiredHost, *syncError) {
+	if host, found := hosts[fqdn]; found {
+		return host, nil
+	}
+	if _, found := store.Get(fqdn); found {
+		err := fmt.Errorf("%v is synced by another client", fqdn)
+		return nil, &syncError{step: "validate", status: http.StatusConflict, err: err}
+	}
+	return nil, nil
+}
+
+func removeWebhookRecord(hosts map[string]*desiredHost, endpoint *webhookEndpoint, changed map[string]bool) *syncError {
+	name, target, failure := webhookRecord(endpoint)
+	if failure != nil {
+		return failure
+	}
+	fqdn := name
+	if endpoint.RecordType == "CNAME" {
+		fqdn = target
+	}
+	host, failure := ownedWebhookHost(hosts, fqdn)
+	if failure != nil || host == nil {
+		return failure
+	}
+	if endpoint.RecordType == "CNAME" {
+		host.Aliases = removeString(host.Aliases, name)
+	} else {
+		var addresses []string
+		for _, address := range host.Addresses {
+			if recordType, _ := opnsense.RecordTypeForIP(address); recordType != endpoint.RecordType {
+				addresses = append(addresses, address)
+			}
+		}
+		host.Addresses = addresses
+	}
+	changed[fqdn] = true
+	return nil
+}
+
+func addWebhookAddress(ctx context.Context, hosts map[string]*desiredHost, endpoint *webhookEndpoint, changed map[string]bool) *syncError {
+	name, address, failure := webhookRecord(endpoint)
+	if failure != nil {
+		return failure
+	}
+	recordType, err := opnsense.RecordTypeForIP(address)
+	if err != nil || recordType != endpoint.RecordType {
+		err := fmt.Errorf("%v is no valid target of %v record %v", address, endpoint.RecordType, name)
+		return &syncError{step: "validate", status: http.StatusBadRequest, err: err}
+	}
+	host, failure := ownedWebhookHost(hosts, name)
+	if failure != nil {
+		return failure
+	}
+	if host == nil {
+		failure = checkUnmanagedRecords(ctx, name)
+		if failure != nil {
+			return failure
+		}
+		host = &desiredHost{Host: name, Owner: webhookOwner}
+		hosts[name] = host
+	}
+	addresses := []string{address}
+	for _, existing := range host.Addresses {
+		if existingType, _ := opnsense.RecordTypeForIP(existing); existingType != recordType {
+			addresses = append(addresses, existing)
+		}
+	}
+	host.Addresses, _ = normalizeAddresses(addresses)
+	changed[name] = true
+	return nil
+}
+
+func addWebhookAlias(ctx context.Context, hosts map[string]*desiredHost, endpoint *webhookEndpoint, changed map[string]bool) *syncError {
+	name, target, failure := webhookRecord(endpoint)
+	if failure != nil {
+		return failure
+	}
+	host := hosts[target]
+	if host == nil || len(host.Addresses) == 0 {
+		err := fmt.Errorf("CNAME record %v must point to an A or AAAA record of ExternalDNS, not %v", name, target)
+		return &syncError{step: "validate", status: http.StatusBadRequest, err: err}
+	}
+	if !containsString(host.Aliases, name) {
+		failure = checkUnmanagedRecords(ctx, name)
+		if failure != nil {
+			return failure
+		}
+		host.Aliases = append(host.Aliases, name)
+		sort.Strings(host.Aliases)
+	}
+	changed[target] = true
+	return nil
+}
+
+// syncWebhookHost syncs the desired state of host, or deletes it if no address is left.
+func syncWebhookHost(ctx context.Context, host *desiredHost) *syncError {
+	ctx = opnsense.WithLogger(ctx, opnsense.Logger(ctx).WithField("host", host.Host))
+	if len(host.Addresses) == 0 {
+		if _, found := store.Get(host.Host); !found {
+			return nil
+		}
+		failure := removeHost(ctx, host.Host, false, newDeleteHostResponse(host.Host), false)
+		if failure != nil && failure.status != http.StatusNotFound {
+			return failure
+		}
+		if failure != nil {
+			// no target knew the host, so its desired state was not removed
+			err := store.Delete(host.Host)
+			if err != nil {
+				return &syncError{step: "store", status: http.StatusInternalServerError, err: err}
+			}
+		}
+		return nil
+	}
+	if host.Aliases == nil {
+		host.Aliases = []string{}
+	}
+	request := syncAliasesRequest{Host: host.Host, Aliases: host.Aliases, Addresses: host.Addresses, Owner: webhookOwner}
+	response := newSyncAliasesResponse()
+	response.Host = host.Host
+	failure := syncHost(ctx, request, host.Addresses, response, false)
+	status := http.StatusOK
+	if failure != nil {
+		status = failure.status
+	}
+	syncsTotal.WithLabelValues(syncOutcome(status, false)).Inc()
+	return failure
+}
+
+func removeString(values []string, value string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}